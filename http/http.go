@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -11,6 +12,7 @@ type Server struct {
 	port          uint16
 	ReturnChannel chan string
 	ErrorChannel  chan error
+	started       sync.Once
 }
 
 func missingPass(w http.ResponseWriter, _ *http.Request) {
@@ -31,7 +33,12 @@ func missingPass(w http.ResponseWriter, _ *http.Request) {
 	fmt.Fprint(w, htmlText)
 }
 
+// RunHTTPServer starts the server once, it keeps running so every next call reuses it
 func (hs *Server) RunHTTPServer() {
+	hs.started.Do(hs.serve)
+}
+
+func (hs *Server) serve() {
 	// listen on port for callback and return code to the channel
 	http.HandleFunc("/", func(_ http.ResponseWriter, r *http.Request) {
 		q := r.URL.Query()
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"os"
 
 	"kdbxsync/http"
 	"kdbxsync/keepass"
@@ -14,7 +18,7 @@ type app struct {
 	keepass *keepass.DBSync
 }
 
-func initApp(credentials string, hhtpServerPort uint16, keychainAccessPath string) (*app, error) {
+func initApp(credentials string, hhtpServerPort uint16, keychainAccessPath string, dryRun bool) (*app, error) {
 	httpServer := http.NewHTTPServer(hhtpServerPort)
 	keychainAccess, err := keychain.NewKeychainAccess(keychainAccessPath)
 	if err != nil {
@@ -24,11 +28,19 @@ func initApp(credentials string, hhtpServerPort uint16, keychainAccessPath strin
 	if err != nil {
 		return nil, err
 	}
+	var replicas []keepass.ReplicaStorage
+	for _, path := range appSetting.DatabaseSettings.Replicas {
+		replicas = append(replicas, storage.NewFileStorage(path))
+	}
 	storage, err := storage.NewStorage(appSetting)
 	if err != nil {
 		return nil, err
 	}
-	keepassSync, err := keepass.InitKeepassDBSync(appSetting, storage)
+	initKeepassDBSync := keepass.InitKeepassDBSync
+	if dryRun {
+		initKeepassDBSync = keepass.InitKeepassDBDryRun
+	}
+	keepassSync, err := initKeepassDBSync(appSetting, storage, replicas...)
 	if err != nil {
 		return nil, err
 	}
@@ -36,25 +48,66 @@ func initApp(credentials string, hhtpServerPort uint16, keychainAccessPath strin
 	return &app{keepass: keepassSync}, nil
 }
 
-func main() {
-	log.SetPrefix("### ")
-	credentials := "client_credentials.json"
-
-	app, err := initApp(credentials, 3030, "keychain.json")
+// close releases the lock of the database, so the next run doesn't see it as stale
+func (app *app) close() {
+	err := app.keepass.Close()
 	if err != nil {
-		log.Fatalf("Unable to initialize application: %v", err)
+		log.Printf("Unable to release the sync lock: %v", err)
 	}
+}
+
+func (app *app) run(dryRun bool, force bool) error {
+	defer app.close()
 
 	keepassSync := app.keepass
-	err = keepassSync.Backup()
+	keepassSync.SetForce(force)
+	if dryRun {
+		report, err := keepassSync.DryRun()
+		if err != nil {
+			return fmt.Errorf("can't merge keepass bases: %w", err)
+		}
+		err = report.Print(os.Stdout)
+		if err != nil {
+			return fmt.Errorf("can't print the report: %w", err)
+		}
+		return nil
+	}
+
+	err := keepassSync.Backup()
 	if err != nil {
-		log.Fatalf("Unable to backup remote base: %v", err)
+		return fmt.Errorf("can't backup remote base: %w", err)
 	}
 
 	err = keepassSync.Sync()
+	if errors.Is(err, keepass.ErrSyncLimit) {
+		return fmt.Errorf("refusing to sync keepass bases: %w, run with -force if it's expected", err)
+	}
 	if err != nil {
-		log.Fatalf("Unable to sync keepass bases: %v", err)
+		return fmt.Errorf("can't sync keepass bases: %w", err)
+	}
+	if conflicts := keepassSync.Conflicts(); conflicts > 0 {
+		log.Printf("Warning: %d conflicting entries were stored in the \"Sync Conflicts\" group", conflicts)
 	}
-
 	log.Print("Done")
+
+	return nil
+}
+
+func main() {
+	log.SetPrefix("### ")
+	credentials := "client_credentials.json"
+	dryRun := flag.Bool("dry-run", false, "merge in memory and print what a sync would change")
+	force := flag.Bool("force", false, "sync even if the merged database lost too many entries or shrank too much")
+	flag.Parse()
+
+	app, err := initApp(credentials, 3030, "keychain.json", *dryRun)
+	if err != nil {
+		log.Fatalf("Unable to initialize application: %v", err)
+	}
+
+	// the lock is released by run before the exit, log.Fatal skips deferred calls
+	err = app.run(*dryRun, *force)
+	if err != nil {
+		log.Fatalf("Unable to run kdbxsync: %v", err)
+	}
 }
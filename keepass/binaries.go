@@ -0,0 +1,136 @@
+package keepass
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// binaryPool collects attachments of all bases into the sync DB deduplicated by content hash,
+// entries are rewritten to reference the pool so binary ids are comparable between bases
+type binaryPool struct {
+	db  *gokeepasslib.Database
+	ids map[[sha256.Size]byte]int
+	// decoded content sizes by binary id
+	sizes map[int]int64
+}
+
+func newBinaryPool(db *gokeepasslib.Database) *binaryPool {
+	*binariesOf(db) = nil
+	return &binaryPool{db: db, ids: make(map[[sha256.Size]byte]int), sizes: make(map[int]int64)}
+}
+
+// binariesOf returns the binary pool of a DB, it's in the inner header for KDBX 4 and in Meta for KDBX 3.1
+func binariesOf(db *gokeepasslib.Database) *gokeepasslib.Binaries {
+	if db.Header.IsKdbx4() {
+		if db.Content.InnerHeader == nil {
+			db.Content.InnerHeader = &gokeepasslib.InnerHeader{}
+		}
+		return &db.Content.InnerHeader.Binaries
+	}
+	return &db.Content.Meta.Binaries
+}
+
+// binaryContent returns decoded content of an attachment
+func binaryContent(db *gokeepasslib.Database, binary *gokeepasslib.Binary) ([]byte, error) {
+	if db.Header.IsKdbx4() {
+		// KDBX 4 binaries are stored raw, GetContentBytes would try to decode them as base64
+		if !binary.Compressed.Bool {
+			return binary.Content, nil
+		}
+		return binary.GetContentBytes()
+	}
+
+	// KDBX 3.1 binaries are base64 encoded, GetContentBytes pads the decoded content with zeros
+	content, err := base64.StdEncoding.DecodeString(string(binary.Content))
+	if err != nil {
+		return nil, err
+	}
+	if !binary.Compressed.Bool {
+		return content, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	// gokeepasslib doesn't flush the end of the gzip stream it writes, as GetContentBytes it's read without it
+	content, err = io.ReadAll(reader)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+
+	return content, nil
+}
+
+func (pool *binaryPool) add(content []byte, memoryProtection byte) int {
+	hash := sha256.Sum256(content)
+	if id, ok := pool.ids[hash]; ok {
+		return id
+	}
+	binary := pool.db.AddBinary(content)
+	if pooled := binariesOf(pool.db).Find(binary.ID); pooled != nil {
+		pooled.MemoryProtection = memoryProtection
+	}
+	pool.ids[hash] = binary.ID
+	pool.sizes[binary.ID] = int64(len(content))
+
+	return binary.ID
+}
+
+// importTree copies attachments referenced by entries of the tree from the source DB to the pool
+func (pool *binaryPool) importTree(tree *treeIndex, source *gokeepasslib.Database) error {
+	// cache of source binary ids already imported
+	imported := make(map[int]int)
+
+	var importEntry func(entry *gokeepasslib.Entry) error
+	importEntry = func(entry *gokeepasslib.Entry) error {
+		var binaries []gokeepasslib.BinaryReference
+		for _, reference := range entry.Binaries {
+			id, ok := imported[reference.Value.ID]
+			if !ok {
+				binary := source.FindBinary(reference.Value.ID)
+				if binary == nil {
+					// reference to a missing binary, nothing to keep
+					continue
+				}
+				content, err := binaryContent(source, binary)
+				if err != nil {
+					return fmt.Errorf("can't read attachment %s: %w", reference.Name, err)
+				}
+				id = pool.add(content, binary.MemoryProtection)
+				imported[reference.Value.ID] = id
+			}
+			reference.Value.ID = id
+			binaries = append(binaries, reference)
+		}
+		entry.Binaries = binaries
+
+		for i := range entry.Histories {
+			for j := range entry.Histories[i].Entries {
+				err := importEntry(&entry.Histories[i].Entries[j])
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	for _, id := range tree.entryOrder {
+		record := tree.entries[id]
+		err := importEntry(&record.entry)
+		if err != nil {
+			return err
+		}
+		tree.entries[id] = record
+	}
+
+	return nil
+}
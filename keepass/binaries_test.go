@@ -0,0 +1,95 @@
+package keepass_test
+
+import (
+	"testing"
+
+	"kdbxsync/keepass"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+// newTestKDBX4Database creates a KDBX 4 base with cheap Argon2 parameters
+func newTestKDBX4Database(root gokeepasslib.Group) *gokeepasslib.Database {
+	db := gokeepasslib.NewDatabase(gokeepasslib.WithDatabaseKDBXVersion4())
+	db.Header.FileHeaders.KdfParameters.Memory = 64 * 1024
+	db.Header.FileHeaders.KdfParameters.Iterations = 1
+	db.Credentials = gokeepasslib.NewPasswordCredentials("pass")
+	db.Content.Root = &gokeepasslib.RootData{Groups: []gokeepasslib.Group{root}}
+	return db
+}
+
+func attachmentContent(t *testing.T, db *gokeepasslib.Database, entry gokeepasslib.Entry) string {
+	require.Len(t, entry.Binaries, 1)
+	binary := db.FindBinary(entry.Binaries[0].Value.ID)
+	require.NotNil(t, binary)
+	content, err := keepass.BinaryContent(db, binary)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestSyncBasesBinaries(t *testing.T) {
+	rootID := gokeepasslib.NewUUID()
+	localEntryID := gokeepasslib.NewUUID()
+	remoteEntryID := gokeepasslib.NewUUID()
+	sharedEntryID := gokeepasslib.NewUUID()
+
+	t.Run("success: binary pools are merged and deduplicated", func(t *testing.T) {
+		localRoot := mkGroup(rootID, "Root", baseTime)
+		local := newTestDatabase(localRoot)
+		localKey := local.AddBinary([]byte("local key"))
+		localEntry := mkEntry(localEntryID, "Local", "local", baseTime)
+		localEntry.Binaries = append(localEntry.Binaries, localKey.CreateReference("id_local"))
+		local.Content.Root.Groups[0].Entries = append(local.Content.Root.Groups[0].Entries, localEntry)
+
+		remoteRoot := mkGroup(rootID, "Root", baseTime)
+		remote := newTestKDBX4Database(remoteRoot)
+		remoteKey := remote.AddBinary([]byte("remote key"))
+		sharedKey := remote.AddBinary([]byte("local key"))
+		remoteEntry := mkEntry(remoteEntryID, "Remote", "remote", baseTime)
+		remoteEntry.Binaries = append(remoteEntry.Binaries, remoteKey.CreateReference("id_remote"))
+		sharedEntry := mkEntry(sharedEntryID, "Shared", "shared", baseTime)
+		sharedEntry.Binaries = append(sharedEntry.Binaries, sharedKey.CreateReference("id_shared"))
+		remote.Content.Root.Groups[0].Entries = append(remote.Content.Root.Groups[0].Entries, remoteEntry, sharedEntry)
+
+		syncDB := mergeTestDatabases(t, nil, local, remote)
+		entries := syncDB.Content.Root.Groups[0].Entries
+
+		require.Len(t, entries, 3)
+		// the sync DB takes the KDBX 4 format of the remote base
+		assert.True(t, syncDB.Header.IsKdbx4())
+		assert.Len(t, syncDB.Content.InnerHeader.Binaries, 2)
+		assert.Equal(t, "local key", attachmentContent(t, syncDB, entries[0]))
+		assert.Equal(t, "remote key", attachmentContent(t, syncDB, entries[1]))
+		assert.Equal(t, "local key", attachmentContent(t, syncDB, entries[2]))
+	})
+
+	t.Run("success: uncompressed KDBX 3.1 binaries keep their content", func(t *testing.T) {
+		localRoot := mkGroup(rootID, "Root", baseTime)
+		local := newTestDatabase(localRoot)
+		localKey := local.AddBinary(nil)
+		localKey.Compressed = w.NewBoolWrapper(false)
+		require.NoError(t, localKey.SetContent([]byte("a key")))
+		localEntry := mkEntry(localEntryID, "Local", "local", baseTime)
+		localEntry.Binaries = append(localEntry.Binaries, localKey.CreateReference("id_local"))
+		local.Content.Root.Groups[0].Entries = append(local.Content.Root.Groups[0].Entries, localEntry)
+
+		remoteRoot := mkGroup(rootID, "Root", baseTime)
+		remote := newTestDatabase(remoteRoot)
+		remoteKey := remote.AddBinary([]byte("a key"))
+		remoteEntry := mkEntry(remoteEntryID, "Remote", "remote", baseTime)
+		remoteEntry.Binaries = append(remoteEntry.Binaries, remoteKey.CreateReference("id_remote"))
+		remote.Content.Root.Groups[0].Entries = append(remote.Content.Root.Groups[0].Entries, remoteEntry)
+
+		syncDB := mergeTestDatabases(t, nil, local, remote)
+		entries := syncDB.Content.Root.Groups[0].Entries
+
+		require.Len(t, entries, 2)
+		assert.False(t, syncDB.Header.IsKdbx4())
+		assert.Len(t, syncDB.Content.Meta.Binaries, 1)
+		assert.Equal(t, "a key", attachmentContent(t, syncDB, entries[0]))
+		assert.Equal(t, "a key", attachmentContent(t, syncDB, entries[1]))
+	})
+}
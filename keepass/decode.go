@@ -0,0 +1,119 @@
+package keepass
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"reflect"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// dbDecoder decodes bases and keeps an unlocked copy of each of them, a file identical to an already
+// decoded one is copied instead of being decrypted again, so the key derivation is paid once per distinct file
+type dbDecoder struct {
+	decoded map[decodedKey]*gokeepasslib.Database
+	// number of files actually decrypted
+	decrypted int
+}
+
+type decodedKey struct {
+	hash [sha256.Size]byte
+	cred *gokeepasslib.DBCredentials
+}
+
+func newDBDecoder() *dbDecoder {
+	return &dbDecoder{decoded: make(map[decodedKey]*gokeepasslib.Database)}
+}
+
+// decode returns a DB with unlocked protected values, it's never shared with other callers
+func (decoder *dbDecoder) decode(data []byte, cred *gokeepasslib.DBCredentials) (*gokeepasslib.Database, error) {
+	key := decodedKey{hash: sha256.Sum256(data), cred: cred}
+	if db, ok := decoder.decoded[key]; ok {
+		return cloneDatabase(db), nil
+	}
+
+	err := checkKDF(data)
+	if err != nil {
+		return nil, err
+	}
+	db := gokeepasslib.NewDatabase()
+	db.Credentials = cred
+	err = gokeepasslib.NewDecoder(bytes.NewReader(data)).Decode(db)
+	if err != nil {
+		return nil, err
+	}
+	decoder.decrypted++
+	err = db.UnlockProtectedEntries()
+	if err != nil {
+		return nil, fmt.Errorf("can't unlock protected entries: %w", err)
+	}
+	decoder.decoded[key] = cloneDatabase(db)
+
+	return db, nil
+}
+
+// cloneDatabase deep copies a decoded DB so it can be changed without touching the original one,
+// credentials are shared as they are compared by pointer
+func cloneDatabase(db *gokeepasslib.Database) *gokeepasslib.Database {
+	clone := deepCopy(reflect.ValueOf(db)).Interface().(*gokeepasslib.Database)
+	clone.Credentials = db.Credentials
+	return clone
+}
+
+// deepCopy copies pointers, slices and maps reachable through exported fields,
+// unexported fields (e.g. internals of time.Time) are copied by value
+func deepCopy(value reflect.Value) reflect.Value {
+	switch value.Kind() {
+	case reflect.Pointer:
+		if value.IsNil() {
+			return value
+		}
+		copied := reflect.New(value.Elem().Type())
+		copied.Elem().Set(deepCopy(value.Elem()))
+		return copied
+	case reflect.Slice:
+		if value.IsNil() {
+			return value
+		}
+		copied := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+		if isFlat(value.Type().Elem()) {
+			reflect.Copy(copied, value)
+			return copied
+		}
+		for i := 0; i < value.Len(); i++ {
+			copied.Index(i).Set(deepCopy(value.Index(i)))
+		}
+		return copied
+	case reflect.Map:
+		if value.IsNil() {
+			return value
+		}
+		copied := reflect.MakeMapWithSize(value.Type(), value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			copied.SetMapIndex(iter.Key(), deepCopy(iter.Value()))
+		}
+		return copied
+	case reflect.Struct:
+		copied := reflect.New(value.Type()).Elem()
+		copied.Set(value)
+		for i := 0; i < value.NumField(); i++ {
+			if value.Type().Field(i).IsExported() {
+				copied.Field(i).Set(deepCopy(value.Field(i)))
+			}
+		}
+		return copied
+	}
+
+	return value
+}
+
+// isFlat tells whether values of the type can be copied by value, e.g. content of attachments
+func isFlat(valueType reflect.Type) bool {
+	switch valueType.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Map, reflect.Struct, reflect.Interface, reflect.Array:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,395 @@
+package keepass
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// ChangeSet is the difference between two versions of a Keepass DB
+type ChangeSet struct {
+	AddedGroups    []GroupChange
+	RemovedGroups  []GroupChange
+	ModifiedGroups []GroupChange
+
+	AddedEntries    []EntryChange
+	RemovedEntries  []EntryChange
+	ModifiedEntries []EntryChange
+
+	CustomIcons []IconChange
+	// names of changed Meta fields, "MasterKey" when the master key was changed
+	Meta []string
+}
+
+// GroupChange describes an added, removed or modified group
+type GroupChange struct {
+	UUID gokeepasslib.UUID
+	// group names from the root group down to the group
+	Path string
+	// names of changed properties of a modified group, e.g. "Name" or "Location"
+	Properties []string
+}
+
+// EntryChange describes an added, removed or modified entry
+type EntryChange struct {
+	UUID gokeepasslib.UUID
+	// group names from the root group down to the entry title
+	Path        string
+	Fields      []FieldChange
+	Attachments []AttachmentChange
+	// names of changed properties other than string fields and attachments, e.g. "Tags" or "History"
+	Properties []string
+}
+
+// FieldChange describes a changed string field, values of protected fields are never exposed
+type FieldChange struct {
+	Kind      ChangeKind
+	Name      string
+	Protected bool
+	Old       string
+	New       string
+}
+
+// AttachmentChange describes an attachment added, removed or replaced with a different content
+type AttachmentChange struct {
+	Kind ChangeKind
+	Name string
+}
+
+type IconChange struct {
+	Kind ChangeKind
+	UUID gokeepasslib.UUID
+}
+
+// IsEmpty tells whether both versions are the same
+func (changeSet *ChangeSet) IsEmpty() bool {
+	return len(changeSet.AddedGroups) == 0 &&
+		len(changeSet.RemovedGroups) == 0 &&
+		len(changeSet.ModifiedGroups) == 0 &&
+		len(changeSet.AddedEntries) == 0 &&
+		len(changeSet.RemovedEntries) == 0 &&
+		len(changeSet.ModifiedEntries) == 0 &&
+		len(changeSet.CustomIcons) == 0 &&
+		len(changeSet.Meta) == 0
+}
+
+// Diff compares two decoded Keepass DBs, groups and entries are matched by uuid and root groups always match,
+// protected values of both DBs have to be unlocked
+func Diff(oldDB *gokeepasslib.Database, newDB *gokeepasslib.Database) (*ChangeSet, error) {
+	oldTree := newTreeIndex(oldDB.Content.Root)
+	newTree := newTreeIndex(newDB.Content.Root)
+	oldTree.aliasRoot(newTree.rootUUID)
+
+	changeSet := &ChangeSet{}
+	diffGroups(changeSet, oldTree, newTree)
+	err := diffEntries(changeSet, oldDB, oldTree, newDB, newTree)
+	if err != nil {
+		return nil, err
+	}
+	changeSet.CustomIcons = diffCustomIcons(oldDB.Content.Meta.CustomIcons, newDB.Content.Meta.CustomIcons)
+	changeSet.Meta = diffMeta(oldDB.Content.Meta, newDB.Content.Meta)
+
+	return changeSet, nil
+}
+
+func diffGroups(changeSet *ChangeSet, oldTree *treeIndex, newTree *treeIndex) {
+	for _, id := range newTree.groupOrder {
+		record := newTree.groups[id]
+		oldRecord, ok := oldTree.groups[id]
+		if !ok {
+			changeSet.AddedGroups = append(changeSet.AddedGroups, GroupChange{UUID: id, Path: newTree.groupPath(id)})
+			continue
+		}
+
+		var properties []string
+		compare := func(name string, oldValue any, newValue any) {
+			if !reflect.DeepEqual(oldValue, newValue) {
+				properties = append(properties, name)
+			}
+		}
+		oldGroup, group := oldRecord.group, record.group
+		compare("Name", oldGroup.Name, group.Name)
+		compare("Notes", oldGroup.Notes, group.Notes)
+		compare("Icon", [2]any{oldGroup.IconID, oldGroup.CustomIconUUID}, [2]any{group.IconID, group.CustomIconUUID})
+		compare("DefaultAutoTypeSequence", oldGroup.DefaultAutoTypeSequence, group.DefaultAutoTypeSequence)
+		compare("EnableAutoType", oldGroup.EnableAutoType, group.EnableAutoType)
+		compare("EnableSearching", oldGroup.EnableSearching, group.EnableSearching)
+		compare("Location", oldRecord.parent, record.parent)
+		if !lastModified(oldGroup.Times).Equal(lastModified(group.Times)) {
+			properties = append(properties, "LastModificationTime")
+		}
+		if len(properties) > 0 {
+			changeSet.ModifiedGroups = append(changeSet.ModifiedGroups, GroupChange{
+				UUID:       id,
+				Path:       newTree.groupPath(id),
+				Properties: properties,
+			})
+		}
+	}
+
+	for _, id := range oldTree.groupOrder {
+		if _, ok := newTree.groups[id]; !ok {
+			changeSet.RemovedGroups = append(changeSet.RemovedGroups, GroupChange{UUID: id, Path: oldTree.groupPath(id)})
+		}
+	}
+}
+
+func diffEntries(
+	changeSet *ChangeSet,
+	oldDB *gokeepasslib.Database,
+	oldTree *treeIndex,
+	newDB *gokeepasslib.Database,
+	newTree *treeIndex,
+) error {
+	for _, id := range newTree.entryOrder {
+		record := newTree.entries[id]
+		oldRecord, ok := oldTree.entries[id]
+		if !ok {
+			changeSet.AddedEntries = append(changeSet.AddedEntries, EntryChange{UUID: id, Path: newTree.entryPath(id)})
+			continue
+		}
+
+		change := EntryChange{UUID: id, Path: newTree.entryPath(id)}
+		change.Fields = diffFields(oldRecord.entry, record.entry)
+		attachments, err := diffAttachments(oldDB, oldRecord.entry, newDB, record.entry)
+		if err != nil {
+			return err
+		}
+		change.Attachments = attachments
+
+		compare := func(name string, oldValue any, newValue any) {
+			if !reflect.DeepEqual(oldValue, newValue) {
+				change.Properties = append(change.Properties, name)
+			}
+		}
+		oldEntry, entry := oldRecord.entry, record.entry
+		compare("Tags", oldEntry.Tags, entry.Tags)
+		compare("Icon", [2]any{oldEntry.IconID, oldEntry.CustomIconUUID}, [2]any{entry.IconID, entry.CustomIconUUID})
+		compare("ForegroundColor", oldEntry.ForegroundColor, entry.ForegroundColor)
+		compare("BackgroundColor", oldEntry.BackgroundColor, entry.BackgroundColor)
+		compare("OverrideURL", oldEntry.OverrideURL, entry.OverrideURL)
+		compare("AutoType", oldEntry.AutoType, entry.AutoType)
+		compare("CustomData", oldEntry.CustomData, entry.CustomData)
+		compare("Location", oldRecord.parent, record.parent)
+		compare("History", historyVersions(oldEntry), historyVersions(entry))
+		compare("Expiry", expiry(oldEntry.Times), expiry(entry.Times))
+		compare("UsageCount", oldEntry.Times.UsageCount, entry.Times.UsageCount)
+		if !lastModified(oldEntry.Times).Equal(lastModified(entry.Times)) {
+			change.Properties = append(change.Properties, "LastModificationTime")
+		}
+
+		if len(change.Fields) > 0 || len(change.Attachments) > 0 || len(change.Properties) > 0 {
+			changeSet.ModifiedEntries = append(changeSet.ModifiedEntries, change)
+		}
+	}
+
+	for _, id := range oldTree.entryOrder {
+		if _, ok := newTree.entries[id]; !ok {
+			changeSet.RemovedEntries = append(changeSet.RemovedEntries, EntryChange{UUID: id, Path: oldTree.entryPath(id)})
+		}
+	}
+
+	return nil
+}
+
+// diffFields compares standard and custom string fields, a field is protected when it's protected in any version
+func diffFields(oldEntry gokeepasslib.Entry, entry gokeepasslib.Entry) []FieldChange {
+	var changes []FieldChange
+	for _, key := range unionKeys(valueKeys(oldEntry), valueKeys(entry)) {
+		oldValue, value := oldEntry.Get(key), entry.Get(key)
+		change := FieldChange{Name: key}
+		switch {
+		case oldValue == nil:
+			change.Kind = ChangeAdded
+		case value == nil:
+			change.Kind = ChangeDeleted
+		case oldValue.Value.Content != value.Value.Content ||
+			oldValue.Value.Protected.Bool != value.Value.Protected.Bool:
+			change.Kind = ChangeUpdated
+		default:
+			continue
+		}
+		change.Protected = (oldValue != nil && oldValue.Value.Protected.Bool) || (value != nil && value.Value.Protected.Bool)
+		if !change.Protected {
+			if oldValue != nil {
+				change.Old = oldValue.Value.Content
+			}
+			if value != nil {
+				change.New = value.Value.Content
+			}
+		}
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+// diffAttachments compares attachments by name and content, binary ids differ between DBs
+func diffAttachments(
+	oldDB *gokeepasslib.Database,
+	oldEntry gokeepasslib.Entry,
+	newDB *gokeepasslib.Database,
+	entry gokeepasslib.Entry,
+) ([]AttachmentChange, error) {
+	oldHashes, err := attachmentHashes(oldDB, oldEntry)
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := attachmentHashes(newDB, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	var oldNames, names []string
+	for _, reference := range oldEntry.Binaries {
+		oldNames = append(oldNames, reference.Name)
+	}
+	for _, reference := range entry.Binaries {
+		names = append(names, reference.Name)
+	}
+
+	var changes []AttachmentChange
+	for _, name := range unionKeys(oldNames, names) {
+		oldHash, inOld := oldHashes[name]
+		hash, inNew := hashes[name]
+		switch {
+		case !inOld:
+			changes = append(changes, AttachmentChange{Kind: ChangeAdded, Name: name})
+		case !inNew:
+			changes = append(changes, AttachmentChange{Kind: ChangeDeleted, Name: name})
+		case oldHash != hash:
+			changes = append(changes, AttachmentChange{Kind: ChangeUpdated, Name: name})
+		}
+	}
+
+	return changes, nil
+}
+
+func attachmentHashes(db *gokeepasslib.Database, entry gokeepasslib.Entry) (map[string][sha256.Size]byte, error) {
+	hashes := make(map[string][sha256.Size]byte)
+	for _, reference := range entry.Binaries {
+		var content []byte
+		if binary := db.FindBinary(reference.Value.ID); binary != nil {
+			var err error
+			content, err = binaryContent(db, binary)
+			if err != nil {
+				return nil, fmt.Errorf("can't read attachment %s: %w", reference.Name, err)
+			}
+		}
+		hashes[reference.Name] = sha256.Sum256(content)
+	}
+
+	return hashes, nil
+}
+
+func diffCustomIcons(oldIcons []gokeepasslib.CustomIcon, icons []gokeepasslib.CustomIcon) []IconChange {
+	oldData := make(map[gokeepasslib.UUID]string)
+	for _, icon := range oldIcons {
+		oldData[icon.UUID] = icon.Data
+	}
+	var changes []IconChange
+	seen := make(map[gokeepasslib.UUID]bool)
+	for _, icon := range icons {
+		seen[icon.UUID] = true
+		data, ok := oldData[icon.UUID]
+		if !ok {
+			changes = append(changes, IconChange{Kind: ChangeAdded, UUID: icon.UUID})
+		} else if data != icon.Data {
+			changes = append(changes, IconChange{Kind: ChangeUpdated, UUID: icon.UUID})
+		}
+	}
+	for _, icon := range oldIcons {
+		if !seen[icon.UUID] {
+			changes = append(changes, IconChange{Kind: ChangeDeleted, UUID: icon.UUID})
+		}
+	}
+
+	return changes
+}
+
+// diffMeta compares database settings merged by mergeMeta
+func diffMeta(oldMeta *gokeepasslib.MetaData, meta *gokeepasslib.MetaData) []string {
+	var changed []string
+	compare := func(name string, oldValue any, newValue any) {
+		if !reflect.DeepEqual(oldValue, newValue) {
+			changed = append(changed, name)
+		}
+	}
+	compare("DatabaseName", oldMeta.DatabaseName, meta.DatabaseName)
+	compare("DatabaseDescription", oldMeta.DatabaseDescription, meta.DatabaseDescription)
+	compare("DefaultUserName", oldMeta.DefaultUserName, meta.DefaultUserName)
+	compare("Color", oldMeta.Color, meta.Color)
+	compare("RecycleBinEnabled", oldMeta.RecycleBinEnabled.Bool, meta.RecycleBinEnabled.Bool)
+	compare("RecycleBinUUID", oldMeta.RecycleBinUUID, meta.RecycleBinUUID)
+	compare("EntryTemplatesGroup", oldMeta.EntryTemplatesGroup, meta.EntryTemplatesGroup)
+	compare("HistoryMaxItems", oldMeta.HistoryMaxItems, meta.HistoryMaxItems)
+	compare("HistoryMaxSize", oldMeta.HistoryMaxSize, meta.HistoryMaxSize)
+	compare("MaintenanceHistoryDays", oldMeta.MaintenanceHistoryDays, meta.MaintenanceHistoryDays)
+	compare("MasterKeyChangeRec", oldMeta.MasterKeyChangeRec, meta.MasterKeyChangeRec)
+	compare("MasterKeyChangeForce", oldMeta.MasterKeyChangeForce, meta.MasterKeyChangeForce)
+	compare("MemoryProtection", oldMeta.MemoryProtection, meta.MemoryProtection)
+	compare("CustomData", oldMeta.CustomData, meta.CustomData)
+	if !timeOf(oldMeta.MasterKeyChanged).Equal(timeOf(meta.MasterKeyChanged)) {
+		changed = append(changed, "MasterKey")
+	}
+
+	return changed
+}
+
+// expiry returns whether an entry expires and when
+func expiry(times gokeepasslib.TimeData) [2]any {
+	return [2]any{times.Expires.Bool, timeOf(times.ExpiryTime).UnixNano()}
+}
+
+// historyVersions lists modification times of history versions of an entry
+func historyVersions(entry gokeepasslib.Entry) []int64 {
+	var versions []int64
+	for _, history := range entry.Histories {
+		for _, version := range history.Entries {
+			versions = append(versions, lastModified(version.Times).UnixNano())
+		}
+	}
+	return versions
+}
+
+func valueKeys(entry gokeepasslib.Entry) []string {
+	var keys []string
+	for _, value := range entry.Values {
+		keys = append(keys, value.Key)
+	}
+	return keys
+}
+
+// unionKeys lists keys of the first list and appends keys found only in the second one
+func unionKeys(first []string, second []string) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, key := range append(append([]string(nil), first...), second...) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// groupPath joins names of the group and all its parents
+func (index *treeIndex) groupPath(id gokeepasslib.UUID) string {
+	var names []string
+	seen := make(map[gokeepasslib.UUID]bool)
+	for record, ok := index.groups[id]; ok && !seen[id]; record, ok = index.groups[id] {
+		seen[id] = true
+		names = append([]string{record.group.Name}, names...)
+		id = record.parent
+	}
+
+	return strings.Join(names, "/")
+}
+
+func (index *treeIndex) entryPath(id gokeepasslib.UUID) string {
+	record := index.entries[id]
+	return fmt.Sprintf("%s/%s", index.groupPath(record.parent), record.entry.GetTitle())
+}
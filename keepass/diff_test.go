@@ -0,0 +1,156 @@
+package keepass_test
+
+import (
+	"testing"
+	"time"
+
+	"kdbxsync/keepass"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+func TestDiff(t *testing.T) {
+	rootID := gokeepasslib.NewUUID()
+	emailID := gokeepasslib.NewUUID()
+	workID := gokeepasslib.NewUUID()
+	entryID := gokeepasslib.NewUUID()
+	removedID := gokeepasslib.NewUUID()
+
+	mkTime := func(value time.Time) *w.TimeWrapper {
+		timeWrapper := w.Now()
+		timeWrapper.Time = value
+		return &timeWrapper
+	}
+
+	newBase := func() *gokeepasslib.Database {
+		root := mkGroup(rootID, "Root", baseTime)
+		email := mkGroup(emailID, "Email", baseTime)
+		entry := mkEntry(entryID, "Mail", "secret", baseTime)
+		entry.Values = append(entry.Values, mkValue("URL", "https://old.example.com"))
+		email.Entries = append(email.Entries, entry, mkEntry(removedID, "Removed", "removed", baseTime))
+		root.Groups = append(root.Groups, email, mkGroup(workID, "Work", baseTime))
+		db := newTestDatabase(root)
+		db.Content.Meta.MasterKeyChanged = mkTime(baseTime)
+		key := db.AddBinary([]byte("old key"))
+		db.Content.Root.Groups[0].Groups[0].Entries[0].Binaries = append(
+			db.Content.Root.Groups[0].Groups[0].Entries[0].Binaries,
+			key.CreateReference("id_rsa"),
+		)
+		return db
+	}
+
+	t.Run("success: same databases", func(t *testing.T) {
+		changeSet, err := keepass.Diff(newBase(), newBase())
+
+		require.NoError(t, err)
+		assert.True(t, changeSet.IsEmpty())
+	})
+
+	t.Run("success: changes are listed", func(t *testing.T) {
+		newDB := newBase()
+		newDB.Content.Meta.DatabaseName = "Team vault"
+		root := &newDB.Content.Root.Groups[0]
+		// root groups are matched whatever their uuids are
+		root.UUID = gokeepasslib.NewUUID()
+		root.Groups = root.Groups[:1]
+		email := &root.Groups[0]
+		entry := &email.Entries[0]
+		entry.Values = []gokeepasslib.ValueData{
+			mkValue("Title", "Mail"),
+			mkProtectedValue("Password", "changed"),
+			mkValue("URL", "https://new.example.com"),
+			mkValue("Notes", "notes"),
+		}
+		entry.Times = mkTimes(baseTime.Add(time.Hour))
+		key := newDB.AddBinary([]byte("new key"))
+		entry.Binaries = []gokeepasslib.BinaryReference{key.CreateReference("id_rsa")}
+		email.Entries = email.Entries[:1]
+		added := mkEntry(gokeepasslib.NewUUID(), "Added", "added", baseTime)
+		root.Entries = append(root.Entries, added)
+
+		changeSet, err := keepass.Diff(newBase(), newDB)
+
+		require.NoError(t, err)
+		assert.Empty(t, changeSet.AddedGroups)
+		assert.Equal(t, []keepass.GroupChange{{UUID: workID, Path: "Root/Work"}}, changeSet.RemovedGroups)
+		assert.Empty(t, changeSet.ModifiedGroups)
+		assert.Equal(t, []keepass.EntryChange{{UUID: added.UUID, Path: "Root/Added"}}, changeSet.AddedEntries)
+		assert.Equal(t, []keepass.EntryChange{{UUID: removedID, Path: "Root/Email/Removed"}}, changeSet.RemovedEntries)
+		require.Len(t, changeSet.ModifiedEntries, 1)
+		modified := changeSet.ModifiedEntries[0]
+		assert.Equal(t, "Root/Email/Mail", modified.Path)
+		assert.Equal(t, []keepass.FieldChange{
+			{Kind: keepass.ChangeUpdated, Name: "Password", Protected: true},
+			{
+				Kind: keepass.ChangeUpdated,
+				Name: "URL",
+				Old:  "https://old.example.com",
+				New:  "https://new.example.com",
+			},
+			{Kind: keepass.ChangeAdded, Name: "Notes", New: "notes"},
+		}, modified.Fields)
+		assert.Equal(t, []keepass.AttachmentChange{{Kind: keepass.ChangeUpdated, Name: "id_rsa"}}, modified.Attachments)
+		assert.Equal(t, []string{"LastModificationTime"}, modified.Properties)
+		assert.Equal(t, []string{"DatabaseName"}, changeSet.Meta)
+	})
+
+	t.Run("success: moved entry", func(t *testing.T) {
+		newDB := newBase()
+		root := &newDB.Content.Root.Groups[0]
+		root.Groups[1].Entries = append(root.Groups[1].Entries, root.Groups[0].Entries[0])
+		root.Groups[0].Entries = root.Groups[0].Entries[1:]
+
+		changeSet, err := keepass.Diff(newBase(), newDB)
+
+		require.NoError(t, err)
+		require.Len(t, changeSet.ModifiedEntries, 1)
+		assert.Equal(t, "Root/Work/Mail", changeSet.ModifiedEntries[0].Path)
+		assert.Equal(t, []string{"Location"}, changeSet.ModifiedEntries[0].Properties)
+	})
+
+	t.Run("success: expiry and usage count", func(t *testing.T) {
+		newDB := newBase()
+		times := &newDB.Content.Root.Groups[0].Groups[0].Entries[0].Times
+		times.ExpiryTime = mkTime(baseTime.Add(24 * time.Hour))
+		times.Expires = w.NewBoolWrapper(true)
+		times.UsageCount = 3
+
+		changeSet, err := keepass.Diff(newBase(), newDB)
+
+		require.NoError(t, err)
+		require.Len(t, changeSet.ModifiedEntries, 1)
+		assert.Equal(t, "Root/Email/Mail", changeSet.ModifiedEntries[0].Path)
+		assert.Equal(t, []string{"Expiry", "UsageCount"}, changeSet.ModifiedEntries[0].Properties)
+	})
+
+	t.Run("success: master key change", func(t *testing.T) {
+		newDB := newBase()
+		newDB.Content.Meta.MasterKeyChanged = mkTime(baseTime.Add(time.Hour))
+
+		changeSet, err := keepass.Diff(newBase(), newDB)
+
+		require.NoError(t, err)
+		assert.Empty(t, changeSet.ModifiedEntries)
+		assert.Equal(t, []string{"MasterKey"}, changeSet.Meta)
+	})
+
+	t.Run("success: custom icons", func(t *testing.T) {
+		oldDB := newBase()
+		removedIcon := gokeepasslib.CustomIcon{UUID: gokeepasslib.NewUUID(), Data: "cmVtb3ZlZA=="}
+		oldDB.Content.Meta.CustomIcons = append(oldDB.Content.Meta.CustomIcons, removedIcon)
+		newDB := newBase()
+		addedIcon := gokeepasslib.CustomIcon{UUID: gokeepasslib.NewUUID(), Data: "YWRkZWQ="}
+		newDB.Content.Meta.CustomIcons = append(newDB.Content.Meta.CustomIcons, addedIcon)
+
+		changeSet, err := keepass.Diff(oldDB, newDB)
+
+		require.NoError(t, err)
+		assert.Equal(t, []keepass.IconChange{
+			{Kind: keepass.ChangeAdded, UUID: addedIcon.UUID},
+			{Kind: keepass.ChangeDeleted, UUID: removedIcon.UUID},
+		}, changeSet.CustomIcons)
+	})
+}
@@ -0,0 +1,33 @@
+package keepass
+
+import (
+	"kdbxsync/settings"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+func (keepassDBSync *DBSync) SetOutputFormat(format settings.OutputFormat) {
+	keepassDBSync.settings.DatabaseSettings.OutputFormat = format
+}
+
+func (keepassDBSync *DBSync) Decrypted() int {
+	return keepassDBSync.decoder.decrypted
+}
+
+// WriteReplacingJournal leaves the journal of a sync interrupted while the local file was replaced
+func WriteReplacingJournal(dbSettings *settings.DataBaseSettings, previous []byte, merged []byte, backup string) error {
+	return writeJournal(dbSettings, &syncJournal{
+		Stage:    stageReplacing,
+		Previous: hashOf(previous),
+		Merged:   hashOf(merged),
+		Backup:   backup,
+	})
+}
+
+func (keepassDBSync *DBSync) VerifyMerged(data []byte) error {
+	return keepassDBSync.verifyMerged(data)
+}
+
+func BinaryContent(db *gokeepasslib.Database, binary *gokeepasslib.Binary) ([]byte, error) {
+	return binaryContent(db, binary)
+}
@@ -0,0 +1,373 @@
+package keepass
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+// fieldMerge combines changes made to different fields of an entry on both sides,
+// a field changed on both sides is taken from the latest modified version
+// and the other version is kept as a conflict, without a common ancestor
+// it's unknown which side changed a field so the other version only goes to the history
+func fieldMerge(conflict EntryConflict) Resolution {
+	ancestor := conflict.Base
+	if ancestor == nil {
+		ancestor = commonAncestor(conflict.Local, conflict.Remote)
+	}
+	merger := &fieldMerger{
+		ancestor:     ancestor,
+		local:        conflict.Local,
+		remote:       conflict.Remote,
+		preferRemote: isNewer(conflict.Remote.Times, conflict.Local.Times),
+	}
+
+	resolution := Resolution{Entry: merger.merge()}
+	if ancestor != nil && len(merger.conflicts) > 0 {
+		if merger.preferRemote {
+			resolution.Conflicts = append(resolution.Conflicts, conflict.Local)
+		} else {
+			resolution.Conflicts = append(resolution.Conflicts, conflict.Remote)
+		}
+	}
+
+	return resolution
+}
+
+// commonAncestor finds the latest version of an entry present in histories of both sides
+func commonAncestor(local gokeepasslib.Entry, remote gokeepasslib.Entry) *gokeepasslib.Entry {
+	localVersions := make(map[int64]bool)
+	localVersions[lastModified(local.Times).UnixNano()] = true
+	for _, history := range local.Histories {
+		for _, entry := range history.Entries {
+			localVersions[lastModified(entry.Times).UnixNano()] = true
+		}
+	}
+
+	var ancestor *gokeepasslib.Entry
+	checkVersion := func(entry gokeepasslib.Entry) {
+		if !localVersions[lastModified(entry.Times).UnixNano()] {
+			return
+		}
+		if ancestor == nil || isNewer(entry.Times, ancestor.Times) {
+			version := entry
+			ancestor = &version
+		}
+	}
+	checkVersion(remote)
+	for _, history := range remote.Histories {
+		for _, entry := range history.Entries {
+			checkVersion(entry)
+		}
+	}
+
+	return ancestor
+}
+
+// fieldMerger does a three-way merge of entry fields, ancestor is nil when the common version is unknown
+type fieldMerger struct {
+	ancestor     *gokeepasslib.Entry
+	local        gokeepasslib.Entry
+	remote       gokeepasslib.Entry
+	preferRemote bool
+	// names of fields changed on both sides
+	conflicts []string
+}
+
+func (merger *fieldMerger) merge() gokeepasslib.Entry {
+	merged := copyEntry(merger.local)
+	if merger.preferRemote {
+		merged = copyEntry(merger.remote)
+	}
+
+	merged.Values = merger.mergeValues()
+	merged.Binaries = merger.mergeBinaries()
+	merged.CustomData = merger.mergeCustomData()
+	merged.Tags = merger.mergeTags()
+
+	icon := mergeField(merger, "Icon", func(entry *gokeepasslib.Entry) any {
+		return [2]any{entry.IconID, entry.CustomIconUUID}
+	})
+	merged.IconID, merged.CustomIconUUID = icon.IconID, icon.CustomIconUUID
+	merged.ForegroundColor = mergeField(merger, "ForegroundColor", func(entry *gokeepasslib.Entry) any {
+		return entry.ForegroundColor
+	}).ForegroundColor
+	merged.BackgroundColor = mergeField(merger, "BackgroundColor", func(entry *gokeepasslib.Entry) any {
+		return entry.BackgroundColor
+	}).BackgroundColor
+	merged.OverrideURL = mergeField(merger, "OverrideURL", func(entry *gokeepasslib.Entry) any {
+		return entry.OverrideURL
+	}).OverrideURL
+	autoType := mergeField(merger, "AutoType", func(entry *gokeepasslib.Entry) any {
+		return entry.AutoType
+	}).AutoType
+	merged.AutoType = autoType
+	merged.AutoType.Associations = append([]gokeepasslib.AutoTypeAssociation(nil), autoType.Associations...)
+
+	// a combination of both sides is a new version, with the time of one side it would look
+	// unchanged to other clients and that side would never get into the history
+	if !sameFields(merged, merger.local) && !sameFields(merged, merger.remote) {
+		modified := w.Now()
+		if previous := merged.Times.LastModificationTime; previous != nil {
+			modified.Formatted = previous.Formatted
+		}
+		merged.Times.LastModificationTime = &modified
+	}
+
+	return merged
+}
+
+// sameFields compares the fields merged by fieldMerger, times and history are ignored
+func sameFields(first gokeepasslib.Entry, second gokeepasslib.Entry) bool {
+	return reflect.DeepEqual(mergedFields(first), mergedFields(second))
+}
+
+func mergedFields(entry gokeepasslib.Entry) []any {
+	autoType := entry.AutoType
+	autoType.Associations = nilIfEmpty(autoType.Associations)
+	return []any{
+		nilIfEmpty(entry.Values),
+		nilIfEmpty(entry.Binaries),
+		nilIfEmpty(entry.CustomData),
+		entry.Tags,
+		entry.IconID,
+		entry.CustomIconUUID,
+		entry.ForegroundColor,
+		entry.BackgroundColor,
+		entry.OverrideURL,
+		autoType,
+	}
+}
+
+func nilIfEmpty[T any](items []T) []T {
+	if len(items) == 0 {
+		return nil
+	}
+	return items
+}
+
+// mergeField merges a single field read by the getter and returns the version of the entry to take it from
+func mergeField(merger *fieldMerger, name string, get func(entry *gokeepasslib.Entry) any) *gokeepasslib.Entry {
+	localValue := get(&merger.local)
+	remoteValue := get(&merger.remote)
+	switch {
+	case reflect.DeepEqual(localValue, remoteValue):
+		return &merger.local
+	case merger.ancestor != nil && reflect.DeepEqual(localValue, get(merger.ancestor)):
+		return &merger.remote
+	case merger.ancestor != nil && reflect.DeepEqual(remoteValue, get(merger.ancestor)):
+		return &merger.local
+	}
+
+	merger.conflicts = append(merger.conflicts, name)
+	if merger.preferRemote {
+		return &merger.remote
+	}
+	return &merger.local
+}
+
+// mergeKeyed does a three-way merge of a field with a value per key, nil means the key is missing,
+// result is nil when the key is deleted
+func mergeKeyed[T any](merger *fieldMerger, name string, ancestor *T, local *T, remote *T) *T {
+	switch {
+	case reflect.DeepEqual(local, remote):
+		return local
+	case merger.ancestor != nil && reflect.DeepEqual(local, ancestor):
+		return remote
+	case merger.ancestor != nil && reflect.DeepEqual(remote, ancestor):
+		return local
+	case merger.ancestor == nil && local == nil:
+		return remote
+	case merger.ancestor == nil && remote == nil:
+		return local
+	}
+
+	merger.conflicts = append(merger.conflicts, name)
+	if merger.preferRemote {
+		return remote
+	}
+	return local
+}
+
+// orderedKeys lists keys of the preferred version first and appends keys found only on the other side
+func (merger *fieldMerger) orderedKeys(keys func(entry *gokeepasslib.Entry) []string) []string {
+	first, second := &merger.local, &merger.remote
+	if merger.preferRemote {
+		first, second = second, first
+	}
+	seen := make(map[string]bool)
+	var ordered []string
+	for _, entry := range []*gokeepasslib.Entry{first, second} {
+		for _, key := range keys(entry) {
+			if !seen[key] {
+				seen[key] = true
+				ordered = append(ordered, key)
+			}
+		}
+	}
+
+	return ordered
+}
+
+// mergeValues merges standard and custom string fields, protected flag goes with the value
+func (merger *fieldMerger) mergeValues() []gokeepasslib.ValueData {
+	find := func(entry *gokeepasslib.Entry, key string) *gokeepasslib.V {
+		if entry == nil {
+			return nil
+		}
+		value := entry.Get(key)
+		if value == nil {
+			return nil
+		}
+		return &value.Value
+	}
+	keys := merger.orderedKeys(func(entry *gokeepasslib.Entry) []string {
+		var keys []string
+		for _, value := range entry.Values {
+			keys = append(keys, value.Key)
+		}
+		return keys
+	})
+
+	var values []gokeepasslib.ValueData
+	for _, key := range keys {
+		value := mergeKeyed(
+			merger,
+			key,
+			find(merger.ancestor, key),
+			find(&merger.local, key),
+			find(&merger.remote, key),
+		)
+		if value != nil {
+			values = append(values, gokeepasslib.ValueData{Key: key, Value: *value})
+		}
+	}
+
+	return values
+}
+
+// mergeBinaries merges attachments by their names
+func (merger *fieldMerger) mergeBinaries() []gokeepasslib.BinaryReference {
+	find := func(entry *gokeepasslib.Entry, name string) *gokeepasslib.BinaryReference {
+		if entry == nil {
+			return nil
+		}
+		for i := range entry.Binaries {
+			if entry.Binaries[i].Name == name {
+				return &entry.Binaries[i]
+			}
+		}
+		return nil
+	}
+	names := merger.orderedKeys(func(entry *gokeepasslib.Entry) []string {
+		var names []string
+		for _, binary := range entry.Binaries {
+			names = append(names, binary.Name)
+		}
+		return names
+	})
+
+	var binaries []gokeepasslib.BinaryReference
+	for _, name := range names {
+		binary := mergeKeyed(
+			merger,
+			"Attachment "+name,
+			find(merger.ancestor, name),
+			find(&merger.local, name),
+			find(&merger.remote, name),
+		)
+		if binary != nil {
+			binaries = append(binaries, *binary)
+		}
+	}
+
+	return binaries
+}
+
+func (merger *fieldMerger) mergeCustomData() []gokeepasslib.CustomData {
+	find := func(entry *gokeepasslib.Entry, key string) *string {
+		if entry == nil {
+			return nil
+		}
+		for i := range entry.CustomData {
+			if entry.CustomData[i].Key == key {
+				return &entry.CustomData[i].Value
+			}
+		}
+		return nil
+	}
+	keys := merger.orderedKeys(func(entry *gokeepasslib.Entry) []string {
+		var keys []string
+		for _, data := range entry.CustomData {
+			keys = append(keys, data.Key)
+		}
+		return keys
+	})
+
+	var customData []gokeepasslib.CustomData
+	for _, key := range keys {
+		value := mergeKeyed(
+			merger,
+			"CustomData "+key,
+			find(merger.ancestor, key),
+			find(&merger.local, key),
+			find(&merger.remote, key),
+		)
+		if value != nil {
+			customData = append(customData, gokeepasslib.CustomData{Key: key, Value: *value})
+		}
+	}
+
+	return customData
+}
+
+// mergeTags merges tags as a set, a tag added or removed on one side is added or removed in the result
+func (merger *fieldMerger) mergeTags() string {
+	if merger.local.Tags == merger.remote.Tags {
+		return merger.local.Tags
+	}
+	keys := merger.orderedKeys(func(entry *gokeepasslib.Entry) []string {
+		return splitTags(entry.Tags)
+	})
+	hasTag := func(entry *gokeepasslib.Entry, tag string) *bool {
+		if entry == nil {
+			return nil
+		}
+		for _, entryTag := range splitTags(entry.Tags) {
+			if entryTag == tag {
+				found := true
+				return &found
+			}
+		}
+		return nil
+	}
+
+	var tags []string
+	for _, tag := range keys {
+		found := mergeKeyed(
+			merger,
+			"Tags",
+			hasTag(merger.ancestor, tag),
+			hasTag(&merger.local, tag),
+			hasTag(&merger.remote, tag),
+		)
+		if found != nil {
+			tags = append(tags, tag)
+		}
+	}
+
+	return strings.Join(tags, ";")
+}
+
+func splitTags(tags string) []string {
+	var split []string
+	for _, tag := range strings.FieldsFunc(tags, func(r rune) bool { return r == ';' || r == ',' }) {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			split = append(split, tag)
+		}
+	}
+	return split
+}
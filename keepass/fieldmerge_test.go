@@ -0,0 +1,122 @@
+package keepass_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"kdbxsync/keepass"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+func TestFieldMerge(t *testing.T) {
+	rootID := gokeepasslib.NewUUID()
+	entryID := gokeepasslib.NewUUID()
+
+	mkFieldsEntry := func(modified time.Time, url string, password string, tags string) gokeepasslib.Entry {
+		entry := mkEntry(entryID, "Entry", password, modified)
+		entry.Values = append(entry.Values, mkValue("URL", url))
+		entry.Tags = tags
+		return entry
+	}
+	newDatabase := func(entry gokeepasslib.Entry) *gokeepasslib.Database {
+		root := mkGroup(rootID, "Root", baseTime)
+		root.Entries = append(root.Entries, entry)
+		return newTestDatabase(root)
+	}
+	ancestor := mkFieldsEntry(baseTime, "old", "old", "a;b")
+
+	t.Run("success: non-overlapping changes are combined", func(t *testing.T) {
+		base := newDatabase(ancestor)
+		local := newDatabase(mkFieldsEntry(baseTime.Add(time.Hour), "new", "old", "a;b;c"))
+		remote := newDatabase(mkFieldsEntry(baseTime.Add(2*time.Hour), "old", "new", "b"))
+
+		syncDB := mergeTestDatabases(t, base, local, remote)
+		entries := syncDB.Content.Root.Groups[0].Entries
+
+		require.Len(t, entries, 1)
+		assert.Equal(t, "new", entries[0].GetContent("URL"))
+		assert.Equal(t, "new", entries[0].GetPassword())
+		assert.Equal(t, "b;c", entries[0].Tags)
+	})
+
+	t.Run("success: combined version is newer than both sides and keeps them in history", func(t *testing.T) {
+		base := newDatabase(ancestor)
+		localEntry := mkFieldsEntry(baseTime.Add(time.Hour), "new", "old", "a;b")
+		remoteEntry := mkFieldsEntry(baseTime.Add(2*time.Hour), "old", "new", "a;b")
+
+		syncDB := mergeTestDatabases(t, base, newDatabase(localEntry), newDatabase(remoteEntry))
+		entries := syncDB.Content.Root.Groups[0].Entries
+
+		require.Len(t, entries, 1)
+		assert.True(t, entries[0].Times.LastModificationTime.Time.After(baseTime.Add(2*time.Hour)))
+		var history []string
+		for _, version := range entries[0].Histories[0].Entries {
+			history = append(history, version.GetContent("URL")+"/"+version.GetPassword())
+		}
+		assert.Contains(t, history, "new/old")
+		assert.Contains(t, history, "old/new")
+	})
+
+	t.Run("success: version equal to one side gets no new modification time", func(t *testing.T) {
+		base := newDatabase(ancestor)
+		local := newDatabase(mkFieldsEntry(baseTime.Add(time.Hour), "new", "new", "a;b"))
+		remote := newDatabase(mkFieldsEntry(baseTime.Add(2*time.Hour), "old", "new", "a;b"))
+
+		syncDB := mergeTestDatabases(t, base, local, remote)
+		entries := syncDB.Content.Root.Groups[0].Entries
+
+		require.Len(t, entries, 1)
+		assert.Equal(t, baseTime.Add(2*time.Hour), entries[0].Times.LastModificationTime.Time)
+	})
+
+	t.Run("success: common ancestor is found in histories", func(t *testing.T) {
+		localEntry := mkFieldsEntry(baseTime.Add(time.Hour), "new", "old", "a;b")
+		localEntry.Histories = []gokeepasslib.History{{Entries: []gokeepasslib.Entry{ancestor}}}
+		remoteEntry := mkFieldsEntry(baseTime.Add(2*time.Hour), "old", "new", "a;b")
+		remoteEntry.Histories = []gokeepasslib.History{{Entries: []gokeepasslib.Entry{ancestor}}}
+
+		syncDB := mergeTestDatabases(t, nil, newDatabase(localEntry), newDatabase(remoteEntry))
+		entries := syncDB.Content.Root.Groups[0].Entries
+
+		require.Len(t, entries, 1)
+		assert.Equal(t, "new", entries[0].GetContent("URL"))
+		assert.Equal(t, "new", entries[0].GetPassword())
+	})
+
+	t.Run("success: field changed on both sides is taken from the newest version", func(t *testing.T) {
+		base := newDatabase(ancestor)
+		local := newDatabase(mkFieldsEntry(baseTime.Add(time.Hour), "local", "local", "a;b"))
+		remote := newDatabase(mkFieldsEntry(baseTime.Add(2*time.Hour), "old", "remote", "a;b"))
+
+		syncDB := mergeTestDatabases(t, base, local, remote)
+		entries := syncDB.Content.Root.Groups[0].Entries
+
+		require.Len(t, entries, 1)
+		assert.Equal(t, "local", entries[0].GetContent("URL"))
+		assert.Equal(t, "remote", entries[0].GetPassword())
+	})
+
+	t.Run("success: conflicting version is kept in the conflicts group", func(t *testing.T) {
+		base := newDatabase(ancestor)
+		local := newDatabase(mkFieldsEntry(baseTime.Add(time.Hour), "local", "old", "a;b"))
+		remote := newDatabase(mkFieldsEntry(baseTime.Add(2*time.Hour), "remote", "old", "a;b"))
+		var dbSync *keepass.DBSync
+
+		syncDB := mergeTestDatabases(t, base, local, remote, func(sync *keepass.DBSync) { dbSync = sync })
+		root := syncDB.Content.Root.Groups[0]
+		conflicts := findGroup(syncDB.Content.Root.Groups, "Sync Conflicts")
+
+		assert.Equal(t, 1, dbSync.Conflicts())
+		require.Len(t, root.Entries, 1)
+		assert.Equal(t, "remote", root.Entries[0].GetContent("URL"))
+		require.NotNil(t, conflicts)
+		require.Len(t, conflicts.Entries, 1)
+		assert.NotEqual(t, entryID, conflicts.Entries[0].UUID)
+		assert.Equal(t, "local", conflicts.Entries[0].GetContent("URL"))
+		assert.True(t, strings.HasPrefix(conflicts.Entries[0].GetTitle(), "Entry (sync conflict, "))
+	})
+}
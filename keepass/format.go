@@ -0,0 +1,233 @@
+package keepass
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"kdbxsync/settings"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// KDF parameters used when the KDF of the output differs from the KDF of the bases
+const (
+	defaultAESRounds         = 60000
+	defaultArgon2Iterations  = 10
+	defaultArgon2Memory      = 64 * 1024 * 1024
+	defaultArgon2Parallelism = 2
+)
+
+// ErrUnsupportedKDF is returned when a base is protected by a KDF gokeepasslib can't derive the key with
+var ErrUnsupportedKDF = errors.New("unsupported KDF")
+
+// kdfArgon2id is the UUID of Argon2id which KeePass 2.48+ and KeePassXC can use in KDBX 4 files
+var kdfArgon2id = []byte{0x9E, 0x29, 0x8B, 0x19, 0x56, 0xDB, 0x47, 0x73, 0xB2, 0x3D, 0xFC, 0x3E, 0xC6, 0xF0, 0xA1, 0xE6}
+
+// checkKDF reads the header of a file and refuses KDFs other than AES-KDF and Argon2d,
+// gokeepasslib derives the key of any other KDF with AES-KDF and the file looks like it has a wrong password
+func checkKDF(data []byte) error {
+	db := &gokeepasslib.Database{Options: gokeepasslib.NewOptions()}
+	// without credentials decoding stops right after the header is read
+	err := gokeepasslib.NewDecoder(bytes.NewReader(data)).Decode(db)
+	var missing gokeepasslib.ErrRequiredAttributeMissing
+	if !errors.As(err, &missing) {
+		// a broken file is reported by the actual decoding
+		return nil
+	}
+	if !db.Header.IsKdbx4() {
+		return nil
+	}
+
+	kdf := db.Header.FileHeaders.KdfParameters
+	switch {
+	case kdf == nil:
+		return fmt.Errorf("%w: KDF parameters are missing", ErrUnsupportedKDF)
+	case bytes.Equal(kdf.UUID, gokeepasslib.KdfArgon2),
+		bytes.Equal(kdf.UUID, gokeepasslib.KdfAES3),
+		bytes.Equal(kdf.UUID, gokeepasslib.KdfAES4):
+		return nil
+	case bytes.Equal(kdf.UUID, kdfArgon2id):
+		return fmt.Errorf("%w: argon2id, switch the database to argon2d or aes-kdf in the Keepass client", ErrUnsupportedKDF)
+	}
+	return fmt.Errorf("%w: %x", ErrUnsupportedKDF, kdf.UUID)
+}
+
+// outputFormat decides the format of the merged DB, by default it's the strongest format of the bases,
+// settings can force the version, the cipher and the KDF
+func outputFormat(forced settings.OutputFormat, headers ...*gokeepasslib.DBHeader) settings.OutputFormat {
+	strongest := headers[0]
+	for _, header := range headers[1:] {
+		if isStrongerHeader(header, strongest) {
+			strongest = header
+		}
+	}
+	format := formatOf(strongest)
+
+	if forced.Version != "" {
+		format.Version = forced.Version
+	}
+	if forced.Cipher != "" {
+		format.Cipher = forced.Cipher
+	}
+	if forced.KDF != "" && forced.KDF != format.KDF {
+		format = settings.OutputFormat{Version: format.Version, Cipher: format.Cipher, KDF: forced.KDF}
+	}
+	// ChaCha20 and Argon2 need KDBX 4, KDBX 3.1 knows only AES
+	if forced.Version == "" && (format.Cipher == settings.CipherChaCha20 || format.KDF == settings.KDFArgon2) {
+		format.Version = settings.KDBX4
+	}
+	if format.Version == settings.KDBX31 {
+		format.Cipher = settings.CipherAES256
+		if format.KDF != settings.KDFAES {
+			format = settings.OutputFormat{Version: format.Version, Cipher: format.Cipher, KDF: settings.KDFAES}
+		}
+	}
+
+	if format.KDF == settings.KDFAES {
+		format.Rounds = firstPositive(forced.Rounds, format.Rounds, defaultAESRounds)
+		return format
+	}
+	format.Iterations = firstPositive(forced.Iterations, format.Iterations, defaultArgon2Iterations)
+	format.Memory = firstPositive(forced.Memory, format.Memory, defaultArgon2Memory)
+	format.Parallelism = uint32(firstPositive(
+		uint64(forced.Parallelism),
+		uint64(format.Parallelism),
+		defaultArgon2Parallelism,
+	))
+
+	return format
+}
+
+// formatOf reads the version, the cipher and KDF parameters of a header,
+// KDFs other than AES-KDF and Argon2d are refused by checkKDF before the header gets here
+func formatOf(header *gokeepasslib.DBHeader) settings.OutputFormat {
+	fileHeaders := header.FileHeaders
+	format := settings.OutputFormat{Version: settings.KDBX31, Cipher: settings.CipherAES256, KDF: settings.KDFAES}
+	if bytes.Equal(fileHeaders.CipherID, gokeepasslib.CipherChaCha20) {
+		format.Cipher = settings.CipherChaCha20
+	}
+	if !header.IsKdbx4() {
+		format.Rounds = fileHeaders.TransformRounds
+		return format
+	}
+
+	format.Version = settings.KDBX4
+	kdf := fileHeaders.KdfParameters
+	if kdf == nil {
+		return format
+	}
+	if bytes.Equal(kdf.UUID, gokeepasslib.KdfArgon2) {
+		format.KDF = settings.KDFArgon2
+		format.Iterations = kdf.Iterations
+		format.Memory = kdf.Memory
+		format.Parallelism = kdf.Parallelism
+		return format
+	}
+	format.Rounds = kdf.Rounds
+
+	return format
+}
+
+// isStrongerHeader compares the KDF first as the key derivation is what slows down guessing the password:
+// Argon2 beats AES-KDF as it's memory-hard, then the cost within the same KDF, memory times iterations
+// for Argon2 and rounds for AES-KDF, then ChaCha20 beats AES and KDBX 4 beats KDBX 3.1,
+// costs of different KDFs can't be compared, so the caller warns when the chosen KDF differs from a base
+func isStrongerHeader(header *gokeepasslib.DBHeader, than *gokeepasslib.DBHeader) bool {
+	strength := func(format settings.OutputFormat) [4]uint64 {
+		var kdf, cost, cipher, version uint64
+		if format.KDF == settings.KDFArgon2 {
+			kdf = 1
+			cost = format.Memory * format.Iterations
+		} else {
+			cost = format.Rounds
+		}
+		if format.Cipher == settings.CipherChaCha20 {
+			cipher = 1
+		}
+		if format.Version == settings.KDBX4 {
+			version = 1
+		}
+		return [4]uint64{kdf, cost, cipher, version}
+	}
+
+	a, b := strength(formatOf(header)), strength(formatOf(than))
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
+
+// newHeader builds a header of the format with fresh seeds, so they are never reused between writes
+func newHeader(format settings.OutputFormat) *gokeepasslib.DBHeader {
+	if format.Version == settings.KDBX31 {
+		header := gokeepasslib.NewKDBX3Header()
+		header.FileHeaders.TransformRounds = format.Rounds
+		return header
+	}
+
+	header := gokeepasslib.NewKDBX4Header()
+	if format.Cipher == settings.CipherAES256 {
+		header.FileHeaders.CipherID = gokeepasslib.CipherAES
+		header.FileHeaders.EncryptionIV = randomBytes(16)
+	}
+	kdf := header.FileHeaders.KdfParameters
+	if format.KDF == settings.KDFAES {
+		// the AES-KDF id KeePass itself writes into KDBX 4 files
+		*kdf = gokeepasslib.KdfParameters{UUID: gokeepasslib.KdfAES3, Rounds: format.Rounds, Salt: kdf.Salt}
+		return header
+	}
+	kdf.Iterations = format.Iterations
+	kdf.Memory = format.Memory
+	kdf.Parallelism = format.Parallelism
+
+	return header
+}
+
+// setHeader switches the DB to a new header, protected values have to be unlocked as they are locked
+// with a stream key of the header, attachments are dropped as they are encoded differently
+// by KDBX versions and have to be added to the binary pool afterwards
+func setHeader(db *gokeepasslib.Database, header *gokeepasslib.DBHeader) {
+	db.Header = header
+	db.Content.Meta.Binaries = nil
+	if !header.IsKdbx4() {
+		db.Content.InnerHeader = nil
+		return
+	}
+	db.Content.InnerHeader = &gokeepasslib.InnerHeader{
+		InnerRandomStreamID:  gokeepasslib.ChaChaStreamID,
+		InnerRandomStreamKey: randomBytes(64),
+	}
+}
+
+func describeFormat(format settings.OutputFormat) string {
+	kdf := fmt.Sprintf("%s with %d rounds", format.KDF, format.Rounds)
+	if format.KDF == settings.KDFArgon2 {
+		kdf = fmt.Sprintf(
+			"%s with %d iterations, %d MiB and %d threads",
+			format.KDF,
+			format.Iterations,
+			format.Memory/1024/1024,
+			format.Parallelism,
+		)
+	}
+	return fmt.Sprintf("kdbx %s, %s, %s", format.Version, format.Cipher, kdf)
+}
+
+func firstPositive(values ...uint64) uint64 {
+	for _, value := range values {
+		if value > 0 {
+			return value
+		}
+	}
+	return 0
+}
+
+func randomBytes(size int) []byte {
+	data := make([]byte, size)
+	_, _ = rand.Read(data)
+	return data
+}
@@ -0,0 +1,173 @@
+package keepass_test
+
+import (
+	"bytes"
+	"testing"
+
+	"kdbxsync/keepass"
+	"kdbxsync/settings"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+func TestSyncBasesOutputFormat(t *testing.T) {
+	rootID := gokeepasslib.NewUUID()
+	entryID := gokeepasslib.NewUUID()
+
+	newBase := func(db *gokeepasslib.Database) *gokeepasslib.Database {
+		entry := mkEntry(entryID, "Mail", "secret", baseTime)
+		key := db.AddBinary([]byte("ssh key"))
+		entry.Binaries = append(entry.Binaries, key.CreateReference("id_rsa"))
+		db.Content.Root.Groups[0].Entries = append(db.Content.Root.Groups[0].Entries, entry)
+		return db
+	}
+	withFormat := func(format settings.OutputFormat) func(dbSync *keepass.DBSync) {
+		return func(dbSync *keepass.DBSync) {
+			dbSync.SetOutputFormat(format)
+		}
+	}
+	assertContent := func(t *testing.T, syncDB *gokeepasslib.Database) {
+		entries := syncDB.Content.Root.Groups[0].Entries
+		require.Len(t, entries, 1)
+		assert.Equal(t, "secret", entries[0].GetPassword())
+		assert.Equal(t, "ssh key", attachmentContent(t, syncDB, entries[0]))
+	}
+
+	t.Run("success: the strongest format is kept", func(t *testing.T) {
+		local := newBase(newTestDatabase(mkGroup(rootID, "Root", baseTime)))
+		remote := newBase(newTestKDBX4Database(mkGroup(rootID, "Root", baseTime)))
+
+		syncDB := mergeTestDatabases(t, nil, local, remote)
+
+		require.True(t, syncDB.Header.IsKdbx4())
+		fileHeaders := syncDB.Header.FileHeaders
+		assert.Equal(t, gokeepasslib.CipherChaCha20, fileHeaders.CipherID)
+		assert.Equal(t, gokeepasslib.KdfArgon2, fileHeaders.KdfParameters.UUID)
+		assert.Equal(t, uint64(64*1024), fileHeaders.KdfParameters.Memory)
+		assert.Equal(t, uint64(1), fileHeaders.KdfParameters.Iterations)
+		// seeds are never reused
+		assert.NotEqual(t, remote.Header.FileHeaders.MasterSeed, fileHeaders.MasterSeed)
+		assert.NotEqual(t, remote.Header.FileHeaders.KdfParameters.Salt, fileHeaders.KdfParameters.Salt)
+		assertContent(t, syncDB)
+	})
+
+	t.Run("success: stronger AES-KDF is kept", func(t *testing.T) {
+		local := newBase(newTestDatabase(mkGroup(rootID, "Root", baseTime)))
+		remote := newBase(newTestDatabase(mkGroup(rootID, "Root", baseTime)))
+		remote.Header.FileHeaders.TransformRounds = 10000
+
+		syncDB := mergeTestDatabases(t, nil, local, remote)
+
+		assert.False(t, syncDB.Header.IsKdbx4())
+		assert.Equal(t, uint64(10000), syncDB.Header.FileHeaders.TransformRounds)
+		assertContent(t, syncDB)
+	})
+
+	t.Run("success: more AES-KDF rounds beat a newer version", func(t *testing.T) {
+		local := newBase(newTestDatabase(mkGroup(rootID, "Root", baseTime)))
+		local.Header.FileHeaders.TransformRounds = 10000
+		remote := newBase(newTestKDBX4Database(mkGroup(rootID, "Root", baseTime)))
+		remote.Header.FileHeaders.CipherID = gokeepasslib.CipherAES
+		remote.Header.FileHeaders.EncryptionIV = make([]byte, 16)
+		*remote.Header.FileHeaders.KdfParameters = gokeepasslib.KdfParameters{UUID: gokeepasslib.KdfAES3, Rounds: 1000}
+
+		syncDB := mergeTestDatabases(t, nil, local, remote)
+
+		assert.False(t, syncDB.Header.IsKdbx4())
+		assert.Equal(t, uint64(10000), syncDB.Header.FileHeaders.TransformRounds)
+		assertContent(t, syncDB)
+	})
+
+	t.Run("success: ChaCha20 beats AES with the same KDF", func(t *testing.T) {
+		local := newBase(newTestKDBX4Database(mkGroup(rootID, "Root", baseTime)))
+		local.Header.FileHeaders.CipherID = gokeepasslib.CipherAES
+		local.Header.FileHeaders.EncryptionIV = make([]byte, 16)
+		remote := newBase(newTestKDBX4Database(mkGroup(rootID, "Root", baseTime)))
+
+		syncDB := mergeTestDatabases(t, nil, local, remote)
+
+		assert.Equal(t, gokeepasslib.CipherChaCha20, syncDB.Header.FileHeaders.CipherID)
+		assertContent(t, syncDB)
+	})
+
+	t.Run("success: forced KDBX 3.1", func(t *testing.T) {
+		local := newBase(newTestKDBX4Database(mkGroup(rootID, "Root", baseTime)))
+		remote := newBase(newTestKDBX4Database(mkGroup(rootID, "Root", baseTime)))
+
+		syncDB := mergeTestDatabases(t, nil, local, remote, withFormat(settings.OutputFormat{
+			Version: settings.KDBX31,
+			Rounds:  1000,
+		}))
+
+		assert.False(t, syncDB.Header.IsKdbx4())
+		assert.Equal(t, gokeepasslib.CipherAES, syncDB.Header.FileHeaders.CipherID)
+		assert.Equal(t, uint64(1000), syncDB.Header.FileHeaders.TransformRounds)
+		assert.Len(t, syncDB.Content.Meta.Binaries, 1)
+		assertContent(t, syncDB)
+	})
+
+	t.Run("success: forced cipher and KDF", func(t *testing.T) {
+		local := newBase(newTestDatabase(mkGroup(rootID, "Root", baseTime)))
+		remote := newBase(newTestDatabase(mkGroup(rootID, "Root", baseTime)))
+
+		syncDB := mergeTestDatabases(t, nil, local, remote, withFormat(settings.OutputFormat{
+			Cipher:      settings.CipherChaCha20,
+			KDF:         settings.KDFArgon2,
+			Iterations:  1,
+			Memory:      64 * 1024,
+			Parallelism: 1,
+		}))
+
+		require.True(t, syncDB.Header.IsKdbx4())
+		fileHeaders := syncDB.Header.FileHeaders
+		assert.Equal(t, gokeepasslib.CipherChaCha20, fileHeaders.CipherID)
+		assert.Equal(t, gokeepasslib.KdfArgon2, fileHeaders.KdfParameters.UUID)
+		assert.Equal(t, uint32(1), fileHeaders.KdfParameters.Parallelism)
+		assertContent(t, syncDB)
+	})
+
+	t.Run("success: forced AES in KDBX 4", func(t *testing.T) {
+		local := newBase(newTestKDBX4Database(mkGroup(rootID, "Root", baseTime)))
+		remote := newBase(newTestDatabase(mkGroup(rootID, "Root", baseTime)))
+
+		syncDB := mergeTestDatabases(t, nil, local, remote, withFormat(settings.OutputFormat{
+			Cipher: settings.CipherAES256,
+			KDF:    settings.KDFAES,
+			Rounds: 1000,
+		}))
+
+		require.True(t, syncDB.Header.IsKdbx4())
+		fileHeaders := syncDB.Header.FileHeaders
+		assert.Equal(t, gokeepasslib.CipherAES, fileHeaders.CipherID)
+		assert.Equal(t, gokeepasslib.KdfAES3, fileHeaders.KdfParameters.UUID)
+		assert.Equal(t, uint64(1000), fileHeaders.KdfParameters.Rounds)
+		assertContent(t, syncDB)
+	})
+}
+
+func TestNewKeepassDBSyncUnsupportedKDF(t *testing.T) {
+	// Argon2id KDF parameters of KeePassXC, gokeepasslib doesn't know the UUID
+	argon2id := []byte{0x9E, 0x29, 0x8B, 0x19, 0x56, 0xDB, 0x47, 0x73, 0xB2, 0x3D, 0xFC, 0x3E, 0xC6, 0xF0, 0xA1, 0xE6}
+	localData := encodeTestDatabase(t, newTestKDBX4Database(mkGroup(gokeepasslib.NewUUID(), "Root", baseTime)))
+	remote := newTestKDBX4Database(mkGroup(gokeepasslib.NewUUID(), "Root", baseTime))
+	remote.Header.FileHeaders.KdfParameters.UUID = argon2id
+	remoteData := encodeTestDatabase(t, remote)
+	appSettings := newTestSettings(t)
+	passwords := &fakePasswords{password: "pass"}
+	appSettings.Passwords = passwords
+
+	dbSync, err := keepass.NewKeepassDBSync(
+		bytes.NewReader(localData),
+		bytes.NewReader(remoteData),
+		&fakeStorage{},
+		appSettings,
+	)
+
+	assert.ErrorIs(t, err, keepass.ErrUnsupportedKDF)
+	assert.ErrorContains(t, err, "argon2id")
+	assert.Nil(t, dbSync)
+	// the password is right, so it's never asked for
+	assert.Equal(t, 0, passwords.prompts)
+}
@@ -0,0 +1,101 @@
+package keepass
+
+import (
+	"sort"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// mergeHistories pushes the losing version of an entry into the history of the winning one,
+// unions histories of both versions deduplicated by modification time
+// and trims the result according to the DB history limits, binarySizes are sizes of pooled attachments by id
+func mergeHistories(
+	winner gokeepasslib.Entry,
+	loser gokeepasslib.Entry,
+	meta *gokeepasslib.MetaData,
+	binarySizes map[int]int64,
+) gokeepasslib.Entry {
+	seen := map[int64]bool{lastModified(winner.Times).UnixNano(): true}
+	var historyEntries []gokeepasslib.Entry
+
+	addHistoryEntry := func(entry gokeepasslib.Entry) {
+		modified := lastModified(entry.Times).UnixNano()
+		if seen[modified] {
+			return
+		}
+		seen[modified] = true
+		entry.Histories = nil
+		historyEntries = append(historyEntries, entry)
+	}
+
+	for _, history := range winner.Histories {
+		for _, entry := range history.Entries {
+			addHistoryEntry(entry)
+		}
+	}
+	for _, history := range loser.Histories {
+		for _, entry := range history.Entries {
+			addHistoryEntry(entry)
+		}
+	}
+	addHistoryEntry(loser)
+
+	// keepass keeps the history from the oldest to the latest version
+	sort.SliceStable(historyEntries, func(i, j int) bool {
+		return lastModified(historyEntries[i].Times).Before(lastModified(historyEntries[j].Times))
+	})
+	historyEntries = trimHistory(historyEntries, meta, binarySizes)
+
+	winner.Histories = nil
+	if len(historyEntries) > 0 {
+		winner.Histories = []gokeepasslib.History{{Entries: historyEntries}}
+	}
+
+	return winner
+}
+
+// trimHistory drops the oldest versions above HistoryMaxItems and HistoryMaxSize, negative limits are unlimited
+func trimHistory(
+	historyEntries []gokeepasslib.Entry,
+	meta *gokeepasslib.MetaData,
+	binarySizes map[int]int64,
+) []gokeepasslib.Entry {
+	if meta == nil {
+		return historyEntries
+	}
+	if meta.HistoryMaxItems >= 0 && int64(len(historyEntries)) > meta.HistoryMaxItems {
+		historyEntries = historyEntries[int64(len(historyEntries))-meta.HistoryMaxItems:]
+	}
+	if meta.HistoryMaxSize >= 0 {
+		var size int64
+		for _, entry := range historyEntries {
+			size += approximateEntrySize(entry, binarySizes)
+		}
+		for len(historyEntries) > 0 && size > meta.HistoryMaxSize {
+			size -= approximateEntrySize(historyEntries[0], binarySizes)
+			historyEntries = historyEntries[1:]
+		}
+	}
+
+	return historyEntries
+}
+
+// approximateEntrySize estimates the size of an entry from its text fields and attachments as keepass does
+func approximateEntrySize(entry gokeepasslib.Entry, binarySizes map[int]int64) int64 {
+	size := len(entry.Tags) + len(entry.OverrideURL) + len(entry.AutoType.DefaultSequence)
+	for _, value := range entry.Values {
+		size += len(value.Key) + len(value.Value.Content)
+	}
+	for _, association := range entry.AutoType.Associations {
+		size += len(association.Window) + len(association.KeystrokeSequence)
+	}
+	for _, data := range entry.CustomData {
+		size += len(data.Key) + len(data.Value)
+	}
+	total := int64(size)
+	for _, reference := range entry.Binaries {
+		total += binarySizes[reference.Value.ID]
+	}
+
+	return total
+}
@@ -0,0 +1,91 @@
+package keepass_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+func TestSyncBasesHistories(t *testing.T) {
+	rootID := gokeepasslib.NewUUID()
+	entryID := gokeepasslib.NewUUID()
+
+	newDatabase := func(password string, modified time.Time, historyPasswords ...string) *gokeepasslib.Database {
+		root := mkGroup(rootID, "Root", baseTime)
+		entry := mkEntry(entryID, "Entry", password, modified)
+		history := gokeepasslib.History{}
+		for i, historyPassword := range historyPasswords {
+			history.Entries = append(
+				history.Entries,
+				mkEntry(entryID, "Entry", historyPassword, baseTime.Add(time.Duration(i)*time.Minute)),
+			)
+		}
+		entry.Histories = append(entry.Histories, history)
+		root.Entries = append(root.Entries, entry)
+		return newTestDatabase(root)
+	}
+	historyPasswords := func(entry gokeepasslib.Entry) []string {
+		passwords := []string{}
+		for _, history := range entry.Histories {
+			for _, historyEntry := range history.Entries {
+				passwords = append(passwords, historyEntry.GetPassword())
+			}
+		}
+		return passwords
+	}
+
+	t.Run("success: losing version is pushed into history", func(t *testing.T) {
+		local := newDatabase("local", baseTime.Add(time.Hour), "first", "second")
+		remote := newDatabase("remote", baseTime.Add(2*time.Hour), "first")
+
+		syncDB := mergeTestDatabases(t, nil, local, remote)
+		entries := syncDB.Content.Root.Groups[0].Entries
+
+		require.Len(t, entries, 1)
+		assert.Equal(t, "remote", entries[0].GetPassword())
+		assert.Equal(t, []string{"first", "second", "local"}, historyPasswords(entries[0]))
+	})
+
+	t.Run("success: history is trimmed to the limits", func(t *testing.T) {
+		local := newDatabase("local", baseTime.Add(time.Hour), "first", "second")
+		local.Content.Meta.HistoryMaxItems = 2
+		remote := newDatabase("remote", baseTime.Add(2*time.Hour), "first")
+
+		syncDB := mergeTestDatabases(t, nil, local, remote)
+		entries := syncDB.Content.Root.Groups[0].Entries
+
+		require.Len(t, entries, 1)
+		assert.Equal(t, []string{"second", "local"}, historyPasswords(entries[0]))
+	})
+
+	t.Run("success: attachments count in the history size", func(t *testing.T) {
+		local := newDatabase("local", baseTime.Add(time.Hour), "first", "second")
+		local.Content.Meta.HistoryMaxSize = 1024
+		key := local.AddBinary(bytes.Repeat([]byte("k"), 2048))
+		first := &local.Content.Root.Groups[0].Entries[0].Histories[0].Entries[0]
+		first.Binaries = append(first.Binaries, key.CreateReference("id_rsa"))
+		remote := newDatabase("remote", baseTime.Add(2*time.Hour))
+		remote.Content.Meta.HistoryMaxSize = 1024
+
+		syncDB := mergeTestDatabases(t, nil, local, remote)
+		entries := syncDB.Content.Root.Groups[0].Entries
+
+		require.Len(t, entries, 1)
+		assert.Equal(t, []string{"second", "local"}, historyPasswords(entries[0]))
+	})
+
+	t.Run("success: unchanged entry keeps its history", func(t *testing.T) {
+		local := newDatabase("same", baseTime.Add(time.Hour), "first")
+		remote := newDatabase("same", baseTime.Add(time.Hour), "first")
+
+		syncDB := mergeTestDatabases(t, nil, local, remote)
+		entries := syncDB.Content.Root.Groups[0].Entries
+
+		require.Len(t, entries, 1)
+		assert.Equal(t, []string{"first"}, historyPasswords(entries[0]))
+	})
+}
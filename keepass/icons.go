@@ -0,0 +1,43 @@
+package keepass
+
+import (
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// mergeCustomIcons unions custom icons of all bases by uuid and drops icons no group or entry references,
+// gokeepasslib doesn't read KDBX 4.1 icon modification times so the first version wins on a uuid collision
+func mergeCustomIcons(groups []gokeepasslib.Group, iconSets ...[]gokeepasslib.CustomIcon) []gokeepasslib.CustomIcon {
+	used := make(map[gokeepasslib.UUID]bool)
+	collectIconUsages(used, groups)
+
+	var merged []gokeepasslib.CustomIcon
+	seen := make(map[gokeepasslib.UUID]bool)
+	for _, icons := range iconSets {
+		for _, icon := range icons {
+			if seen[icon.UUID] || !used[icon.UUID] {
+				continue
+			}
+			seen[icon.UUID] = true
+			merged = append(merged, icon)
+		}
+	}
+
+	return merged
+}
+
+func collectIconUsages(used map[gokeepasslib.UUID]bool, groups []gokeepasslib.Group) {
+	for _, group := range groups {
+		used[group.CustomIconUUID] = true
+		collectEntriesIconUsages(used, group.Entries)
+		collectIconUsages(used, group.Groups)
+	}
+}
+
+func collectEntriesIconUsages(used map[gokeepasslib.UUID]bool, entries []gokeepasslib.Entry) {
+	for _, entry := range entries {
+		used[entry.CustomIconUUID] = true
+		for _, history := range entry.Histories {
+			collectEntriesIconUsages(used, history.Entries)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package keepass_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+func TestSyncBasesCustomIcons(t *testing.T) {
+	rootID := gokeepasslib.NewUUID()
+	entryID := gokeepasslib.NewUUID()
+	usedIconID := gokeepasslib.NewUUID()
+	unusedIconID := gokeepasslib.NewUUID()
+
+	t.Run("success: icons are merged and unused ones dropped", func(t *testing.T) {
+		local := newTestDatabase(mkGroup(rootID, "Root", baseTime))
+		local.Content.Meta.CustomIcons = append(
+			local.Content.Meta.CustomIcons,
+			gokeepasslib.CustomIcon{UUID: unusedIconID, Data: "dW51c2Vk"},
+		)
+		remoteRoot := mkGroup(rootID, "Root", baseTime)
+		entry := mkEntry(entryID, "Entry", "pass", baseTime)
+		entry.CustomIconUUID = usedIconID
+		remoteRoot.Entries = append(remoteRoot.Entries, entry)
+		remote := newTestDatabase(remoteRoot)
+		remote.Content.Meta.CustomIcons = append(
+			remote.Content.Meta.CustomIcons,
+			gokeepasslib.CustomIcon{UUID: usedIconID, Data: "dXNlZA=="},
+		)
+
+		syncDB := mergeTestDatabases(t, nil, local, remote)
+
+		require.Len(t, syncDB.Content.Meta.CustomIcons, 1)
+		assert.Equal(t, usedIconID, syncDB.Content.Meta.CustomIcons[0].UUID)
+		assert.Equal(t, "dXNlZA==", syncDB.Content.Meta.CustomIcons[0].Data)
+	})
+}
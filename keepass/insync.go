@@ -0,0 +1,73 @@
+package keepass
+
+import (
+	"fmt"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// sides returns the local base followed by the remote one and replicas
+func (keepassDBSync *DBSync) sides() []replica {
+	sides := []replica{{name: localReplicaName, db: keepassDBSync.localKeepassDB, size: keepassDBSync.localSize}}
+	return append(sides, keepassDBSync.remoteReplicas()...)
+}
+
+// sidesInSync merges the bases and tells which of them already hold the merge result,
+// those are neither backed up nor written again
+func (keepassDBSync *DBSync) sidesInSync() (map[string]bool, error) {
+	err := keepassDBSync.merge()
+	if err != nil {
+		return nil, err
+	}
+	if keepassDBSync.inSync != nil {
+		return keepassDBSync.inSync, nil
+	}
+
+	inSync := make(map[string]bool)
+	for _, side := range keepassDBSync.sides() {
+		equal, err := keepassDBSync.holdsMerged(side.db)
+		if err != nil {
+			return nil, fmt.Errorf("can't compare %s base: %w", side.name, err)
+		}
+		// the merge input of a base written by an earlier attempt is its version from before the write,
+		// the base itself holds the previous result, so it's written again
+		inSync[side.name] = equal && !keepassDBSync.written[side.name]
+	}
+	keepassDBSync.inSync = inSync
+
+	return inSync, nil
+}
+
+// holdsMerged tells whether a base is semantically equal to the merge result, written with the same key
+// and in the same format, its bytes differ anyway as every write uses fresh seeds
+func (keepassDBSync *DBSync) holdsMerged(db *gokeepasslib.Database) (bool, error) {
+	merged := keepassDBSync.syncKeepassDB
+	if db.Credentials != merged.Credentials || formatOf(db.Header) != formatOf(merged.Header) {
+		return false, nil
+	}
+	if !sameDeletedObjects(db.Content.Root.DeletedObjects, merged.Content.Root.DeletedObjects) {
+		return false, nil
+	}
+	changeSet, err := Diff(db, merged)
+	if err != nil {
+		return false, err
+	}
+
+	return changeSet.IsEmpty(), nil
+}
+
+func sameDeletedObjects(first []gokeepasslib.DeletedObjectData, second []gokeepasslib.DeletedObjectData) bool {
+	if len(first) != len(second) {
+		return false
+	}
+	ids := make(map[gokeepasslib.UUID]bool)
+	for _, deletedObject := range first {
+		ids[deletedObject.UUID] = true
+	}
+	for _, deletedObject := range second {
+		if !ids[deletedObject.UUID] {
+			return false
+		}
+	}
+	return true
+}
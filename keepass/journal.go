@@ -0,0 +1,228 @@
+package keepass
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"kdbxsync/settings"
+)
+
+// stages of a sync recorded in the journal
+const (
+	// the merged DB is being written over the local file
+	stageReplacing = "replacing"
+	// the local file is replaced, stored bases and the snapshot are being updated
+	stageUploading = "uploading"
+)
+
+// syncJournal records a sync in progress, so the next run can finish or roll back an interrupted one
+type syncJournal struct {
+	Stage string `json:"stage"`
+	// sha256 of the local file before the sync
+	Previous string `json:"previous"`
+	// sha256 of the merged DB
+	Merged string `json:"merged"`
+	// backup of the local file made before the sync
+	Backup string `json:"backup"`
+}
+
+func hashOf(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func writeJournal(dbSettings *settings.DataBaseSettings, journal *syncJournal) error {
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dbSettings.StateDirectory, 0700)
+	if err != nil {
+		return fmt.Errorf("can't create state directory: %w", err)
+	}
+	err = WriteFileAtomic(dbSettings.FullJournalFilePath(), data, 0600)
+	if err != nil {
+		return fmt.Errorf("can't write sync journal: %w", err)
+	}
+
+	return nil
+}
+
+func removeJournal(dbSettings *settings.DataBaseSettings) error {
+	err := os.Remove(dbSettings.FullJournalFilePath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("can't remove sync journal: %w", err)
+	}
+	return syncDirectory(dbSettings.StateDirectory)
+}
+
+// RecoverInterruptedSync finishes or rolls back the replacement of the local file left by an interrupted sync,
+// stored bases don't need to be recovered as the next sync merges and uploads them again
+func RecoverInterruptedSync(dbSettings *settings.DataBaseSettings) error {
+	data, err := os.ReadFile(dbSettings.FullJournalFilePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't read sync journal: %w", err)
+	}
+	journal := &syncJournal{}
+	err = json.Unmarshal(data, journal)
+	if err != nil {
+		return fmt.Errorf("can't parse sync journal: %w", err)
+	}
+
+	err = RemoveLeftovers(dbSettings.FullFilePath(), 0)
+	if err != nil {
+		return err
+	}
+
+	if journal.Stage == stageReplacing {
+		err = recoverLocal(dbSettings, journal)
+		if err != nil {
+			return err
+		}
+	} else {
+		log.Print("Previous sync was interrupted after the local Keepass DB was replaced, it's finished by this run")
+	}
+
+	return removeJournal(dbSettings)
+}
+
+// reportInterruptedSync tells about a journal left by an interrupted sync without recovering it
+func reportInterruptedSync(dbSettings *settings.DataBaseSettings) error {
+	_, err := os.Stat(dbSettings.FullJournalFilePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't read sync journal: %w", err)
+	}
+	log.Print("Previous sync was interrupted, it's recovered by the next sync, the local Keepass DB may differ from this report")
+
+	return nil
+}
+
+// recoverLocal keeps the local file whenever it exists, the rename is atomic so the sync leaves either
+// the previous or the merged DB and any other content is changed by the user after the sync,
+// only a missing local file is restored from the backup made before the sync
+func recoverLocal(dbSettings *settings.DataBaseSettings, journal *syncJournal) error {
+	data, err := os.ReadFile(dbSettings.FullFilePath())
+	if err == nil {
+		switch hashOf(data) {
+		case journal.Merged:
+			log.Print("Previous sync was interrupted after the local Keepass DB was replaced, it's finished by this run")
+		case journal.Previous:
+			log.Print("Previous sync was interrupted before the local Keepass DB was replaced, it's rolled back")
+		default:
+			log.Print("Previous sync was interrupted, the local Keepass DB was changed since then and is kept as it is")
+		}
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("can't read local Keepass DB file: %w", err)
+	}
+
+	// the backup keeps the mode of the local file
+	info, err := os.Stat(journal.Backup)
+	if err != nil {
+		return fmt.Errorf("can't read backup of interrupted sync: %w", err)
+	}
+	backup, err := os.ReadFile(journal.Backup)
+	if err != nil {
+		return fmt.Errorf("can't read backup of interrupted sync: %w", err)
+	}
+	if hashOf(backup) != journal.Previous {
+		return fmt.Errorf("backup %s doesn't match the local Keepass DB before the interrupted sync", journal.Backup)
+	}
+	err = WriteFileAtomic(dbSettings.FullFilePath(), backup, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("can't restore local Keepass DB: %w", err)
+	}
+	log.Printf("Previous sync was interrupted while the local Keepass DB was replaced, it's restored from %s", journal.Backup)
+
+	return nil
+}
+
+func tmpFilePattern(path string) string {
+	return fmt.Sprintf(".%s.kdbxsync-*", filepath.Base(path))
+}
+
+// RemoveLeftovers removes tmp files of writes of the file which were interrupted before the rename,
+// so they are incomplete, files modified within the age are kept as another device may still be writing them
+func RemoveLeftovers(path string, age time.Duration) error {
+	leftovers, err := filepath.Glob(filepath.Join(filepath.Dir(path), tmpFilePattern(path)))
+	if err != nil {
+		return err
+	}
+	for _, leftover := range leftovers {
+		info, err := os.Stat(leftover)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("can't get leftover of interrupted write info: %w", err)
+		}
+		if time.Since(info.ModTime()) < age {
+			continue
+		}
+		err = os.Remove(leftover)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("can't remove leftover of interrupted write: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// WriteFileAtomic writes the new content to a file next to the target, syncs it and renames it over the target,
+// so the target is either the old or the new file whenever the process stops
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpFileObj, err := os.CreateTemp(filepath.Dir(path), tmpFilePattern(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFileObj.Name())
+	defer tmpFileObj.Close()
+
+	_, err = tmpFileObj.Write(data)
+	if err != nil {
+		return err
+	}
+	err = tmpFileObj.Chmod(perm)
+	if err != nil {
+		return err
+	}
+	err = tmpFileObj.Sync()
+	if err != nil {
+		return err
+	}
+	err = tmpFileObj.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFileObj.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	// the rename itself is durable only when the directory is synced
+	return syncDirectory(filepath.Dir(path))
+}
+
+func syncDirectory(path string) error {
+	dirObj, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dirObj.Close()
+
+	return dirObj.Sync()
+}
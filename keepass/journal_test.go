@@ -0,0 +1,148 @@
+package keepass_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kdbxsync/keepass"
+	"kdbxsync/settings"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+func TestRecoverInterruptedSync(t *testing.T) {
+	newSettings := func(t *testing.T) *settings.DataBaseSettings {
+		dbSettings := newTestSettings(t).DatabaseSettings
+		dbSettings.BackupDirectory = filepath.Join(dbSettings.Directory, "backups")
+		dbSettings.StateDirectory = filepath.Join(dbSettings.Directory, ".kdbxsync")
+		return dbSettings
+	}
+	previous := []byte("previous db")
+	merged := []byte("merged db")
+	// a sync interrupted while the local file was replaced
+	interrupt := func(t *testing.T, dbSettings *settings.DataBaseSettings, local []byte) {
+		require.NoError(t, os.MkdirAll(dbSettings.BackupDirectory, 0700))
+		backup := filepath.Join(dbSettings.BackupDirectory, "2024-01-01T00-00-00-testfile.kdbx")
+		require.NoError(t, os.WriteFile(backup, previous, 0600))
+		if local != nil {
+			require.NoError(t, os.WriteFile(dbSettings.FullFilePath(), local, 0600))
+		}
+		leftover := filepath.Join(dbSettings.Directory, ".testfile.kdbx.kdbxsync-123")
+		require.NoError(t, os.WriteFile(leftover, merged[:3], 0600))
+		require.NoError(t, keepass.WriteReplacingJournal(dbSettings, previous, merged, backup))
+	}
+	assertRecovered := func(t *testing.T, dbSettings *settings.DataBaseSettings, expected []byte) {
+		data, err := os.ReadFile(dbSettings.FullFilePath())
+		require.NoError(t, err)
+		assert.Equal(t, expected, data)
+		_, err = os.Stat(dbSettings.FullJournalFilePath())
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		leftovers, err := filepath.Glob(filepath.Join(dbSettings.Directory, ".testfile.kdbx.kdbxsync-*"))
+		require.NoError(t, err)
+		assert.Empty(t, leftovers)
+	}
+
+	t.Run("success: nothing to recover", func(t *testing.T) {
+		assert.NoError(t, keepass.RecoverInterruptedSync(newSettings(t)))
+	})
+
+	t.Run("success: interrupted before the rename is rolled back", func(t *testing.T) {
+		dbSettings := newSettings(t)
+		interrupt(t, dbSettings, previous)
+
+		require.NoError(t, keepass.RecoverInterruptedSync(dbSettings))
+
+		assertRecovered(t, dbSettings, previous)
+	})
+
+	t.Run("success: interrupted after the rename is finished", func(t *testing.T) {
+		dbSettings := newSettings(t)
+		interrupt(t, dbSettings, merged)
+
+		require.NoError(t, keepass.RecoverInterruptedSync(dbSettings))
+
+		assertRecovered(t, dbSettings, merged)
+	})
+
+	t.Run("success: missing local file is restored from the backup", func(t *testing.T) {
+		dbSettings := newSettings(t)
+		interrupt(t, dbSettings, nil)
+
+		require.NoError(t, keepass.RecoverInterruptedSync(dbSettings))
+
+		assertRecovered(t, dbSettings, previous)
+	})
+
+	t.Run("success: local file edited after the interrupted sync is kept", func(t *testing.T) {
+		dbSettings := newSettings(t)
+		interrupt(t, dbSettings, []byte("edited db"))
+
+		require.NoError(t, keepass.RecoverInterruptedSync(dbSettings))
+
+		assertRecovered(t, dbSettings, []byte("edited db"))
+	})
+
+	t.Run("success: restored file keeps the mode of the backup", func(t *testing.T) {
+		dbSettings := newSettings(t)
+		interrupt(t, dbSettings, nil)
+		backups, err := os.ReadDir(dbSettings.BackupDirectory)
+		require.NoError(t, err)
+		require.NoError(t, os.Chmod(filepath.Join(dbSettings.BackupDirectory, backups[0].Name()), 0640))
+
+		require.NoError(t, keepass.RecoverInterruptedSync(dbSettings))
+
+		assertRecovered(t, dbSettings, previous)
+		info, err := os.Stat(dbSettings.FullFilePath())
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	})
+
+	t.Run("success: interrupted upload", func(t *testing.T) {
+		remote := newFakeKeepassDatabase()
+		root := &remote.Content.Root.Groups[0]
+		root.Entries = append(root.Entries, mkEntry(gokeepasslib.NewUUID(), "Local", "local", baseTime))
+		localData := encodeTestDatabase(t, remote)
+		root.Entries[1] = mkEntry(gokeepasslib.NewUUID(), "Remote", "remote", baseTime)
+		appSettings := newTestSettings(t)
+		dbSettings := appSettings.DatabaseSettings
+		dbSettings.BackupDirectory = filepath.Join(dbSettings.Directory, "backups")
+		dbSettings.StateDirectory = filepath.Join(dbSettings.Directory, ".kdbxsync")
+		require.NoError(t, os.WriteFile(dbSettings.FullFilePath(), localData, 0600))
+		remoteStorage := &fakeStorage{data: encodeTestDatabase(t, remote), err: errors.New("network is down")}
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(localData),
+			bytes.NewReader(remoteStorage.data),
+			remoteStorage,
+			appSettings,
+		)
+		require.NoError(t, err)
+		require.NoError(t, dbSync.Backup())
+		require.Error(t, dbSync.Sync())
+		merged, err := os.ReadFile(dbSettings.FullFilePath())
+		require.NoError(t, err)
+		_, err = os.Stat(dbSettings.FullJournalFilePath())
+		require.NoError(t, err)
+
+		require.NoError(t, keepass.RecoverInterruptedSync(dbSettings))
+
+		assertRecovered(t, dbSettings, merged)
+	})
+
+	t.Run("error: backup doesn't match", func(t *testing.T) {
+		dbSettings := newSettings(t)
+		interrupt(t, dbSettings, nil)
+		backups, err := os.ReadDir(dbSettings.BackupDirectory)
+		require.NoError(t, err)
+		backup := filepath.Join(dbSettings.BackupDirectory, backups[0].Name())
+		require.NoError(t, os.WriteFile(backup, []byte("other db"), 0600))
+
+		err = keepass.RecoverInterruptedSync(dbSettings)
+
+		assert.EqualError(t, err, "backup "+backup+" doesn't match the local Keepass DB before the interrupted sync")
+	})
+}
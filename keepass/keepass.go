@@ -1,11 +1,16 @@
 package keepass
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
@@ -15,225 +20,804 @@ import (
 )
 
 type Storage interface {
-	UpdateDBFile() error
-	DownloadRemoteKeepassDB() error
+	// UpdateDBFile replaces the stored base with the merged DB, it fails with ErrRemoteChanged
+	// when the base was changed since it was downloaded
+	UpdateDBFile(data []byte) error
+	// DownloadRemoteKeepassDB reads the stored base and remembers its version
+	DownloadRemoteKeepassDB() (io.ReadCloser, error)
 	BackupDBFile() error
 }
 
+// ErrRemoteChanged is returned by storages when another device updated the base during the sync
+var ErrRemoteChanged = errors.New("stored base was changed by another device")
+
+// how many times bases are downloaded and merged again when one of them was changed during the sync
+const maxRemoteChangeRetries = 3
+
+// ReplicaStorage keeps an additional copy of the database
+type ReplicaStorage interface {
+	Storage
+	Name() string
+}
+
+const (
+	localReplicaName = "local"
+	// the replica kept in the main storage
+	remoteReplicaName = "remote"
+)
+
+type replica struct {
+	name    string
+	db      *gokeepasslib.Database
+	storage Storage
+	// size of the encoded base in bytes
+	size int
+}
+
 type DBSync struct {
 	localKeepassDB      *gokeepasslib.Database
 	remoteKeepassDBCopy *gokeepasslib.Database
 	syncKeepassDB       *gokeepasslib.Database
-	storage             Storage
-	settings            *settings.AppSettings
+	baseKeepassDB       *gokeepasslib.Database
+	// names of the bases updated by the last sync, nil when unknown
+	syncedReplicas map[string]bool
+	// additional copies of the database merged and updated along with the remote one
+	replicas  []replica
+	resolver  ConflictResolver
+	conflicts []gokeepasslib.UUID
+	// password the sync DB is written with when the master key was changed on another device
+	newPassword string
+	decoder     *dbDecoder
+	// sizes of the encoded local and remote bases in bytes
+	localSize  int
+	remoteSize int
+	// sync even if the merged DB exceeds limits of the settings
+	force bool
+	// the sync DB holds the merge of the current bases
+	merged bool
+	// names of the bases which already hold the merge result
+	inSync   map[string]bool
+	storage  Storage
+	settings *settings.AppSettings
+	// held from the recovery of an interrupted sync till Close
+	lock *SyncLock
+	// journal of the local file replaced by this sync, kept over retries
+	journal *syncJournal
+	// names of the bases written by an earlier attempt of this sync, their versions from before
+	// the write are kept for the merge, so a retry merges the same way a fresh run would
+	written map[string]bool
 }
 
 func NewKeepassDBSync(
 	localDBFileObj io.Reader,
 	remoteDBCopyFileObj io.Reader,
-	tmpSyncFileObj io.Reader,
 	storage Storage,
 	settings *settings.AppSettings,
 ) (*DBSync, error) {
-	// new db instances to decode files into
-	localDB := gokeepasslib.NewDatabase()
-	remoteDBCopy := gokeepasslib.NewDatabase()
-	syncDB := gokeepasslib.NewDatabase()
-
-	cred := gokeepasslib.NewPasswordCredentials(settings.DatabaseSettings.Password)
-	localDB.Credentials = cred
-	remoteDBCopy.Credentials = cred
-	syncDB.Credentials = cred
-
-	// decoding local remote copy and tmp bases
-	err := gokeepasslib.NewDecoder(localDBFileObj).Decode(localDB)
+	cred, err := newCredentials(settings.DatabaseSettings)
 	if err != nil {
-		return nil, fmt.Errorf("can't initialize local Keepass DB: %w", err)
+		return nil, err
 	}
-	err = gokeepasslib.NewDecoder(remoteDBCopyFileObj).Decode(remoteDBCopy)
+
+	resolver, err := NewConflictResolver(settings.DatabaseSettings.ConflictStrategy)
 	if err != nil {
-		return nil, fmt.Errorf("can't initialize remote Keepass DB copy: %w", err)
+		return nil, err
 	}
-	err = gokeepasslib.NewDecoder(tmpSyncFileObj).Decode(syncDB)
+
+	// decoding local and remote copy bases, protected values stay unlocked while bases are merged
+	decoder := newDBDecoder()
+	localData, err := io.ReadAll(localDBFileObj)
 	if err != nil {
-		return nil, fmt.Errorf("can't initialize tmp sync Keepass DB: %w", err)
+		return nil, fmt.Errorf("can't read local Keepass DB: %w", err)
 	}
-
-	err = localDB.UnlockProtectedEntries()
-	defer localDB.LockProtectedEntries()
+	localDB, err := decoder.decode(localData, cred)
 	if err != nil {
-		return nil, fmt.Errorf("can't unlock protected entries: %w", err)
+		return nil, fmt.Errorf("can't initialize local Keepass DB: %w", err)
 	}
-	err = remoteDBCopy.UnlockProtectedEntries()
-	defer remoteDBCopy.LockProtectedEntries()
+	remoteData, err := io.ReadAll(remoteDBCopyFileObj)
 	if err != nil {
-		return nil, fmt.Errorf("can't unlock protected entries: %w", err)
+		return nil, fmt.Errorf("can't read remote Keepass DB copy: %w", err)
 	}
-	err = syncDB.UnlockProtectedEntries()
-	defer syncDB.LockProtectedEntries()
+	remoteDBCopy, remotePassword, err := decodeRemoteDB(decoder, remoteData, cred, settings)
 	if err != nil {
-		return nil, fmt.Errorf("can't unlock protected entries: %w", err)
+		return nil, fmt.Errorf("can't initialize remote Keepass DB copy: %w", err)
+	}
+	// the sync DB starts as a copy of the local one, it's locked back on save
+	syncDB := cloneDatabase(localDB)
+
+	// the merge result is written with the latest master key
+	var newPassword string
+	if remoteDBCopy.Credentials != cred &&
+		isNewerTime(remoteDBCopy.Content.Meta.MasterKeyChanged, localDB.Content.Meta.MasterKeyChanged) {
+		syncDB.Credentials = remoteDBCopy.Credentials
+		syncDB.Content.Meta.MasterKeyChanged = copyTime(remoteDBCopy.Content.Meta.MasterKeyChanged)
+		newPassword = remotePassword
 	}
 
 	return &DBSync{
 		localKeepassDB:      localDB,
 		remoteKeepassDBCopy: remoteDBCopy,
 		syncKeepassDB:       syncDB,
+		resolver:            resolver,
+		newPassword:         newPassword,
+		decoder:             decoder,
+		localSize:           len(localData),
+		remoteSize:          len(remoteData),
 		settings:            settings,
 		storage:             storage,
 	}, nil
 }
 
-func (keepassDBSync *DBSync) SaveSyncDB() error {
-	syncDBFileObj, err := os.OpenFile(
-		keepassDBSync.settings.DatabaseSettings.FullSyncFilePath(),
-		os.O_WRONLY,
-		os.ModeAppend,
-	)
+// decodeRemoteDB decodes the remote base, when it can't be opened with local credentials
+// because the master password was changed on another device the remote password is asked for
+func decodeRemoteDB(
+	decoder *dbDecoder,
+	data []byte,
+	cred *gokeepasslib.DBCredentials,
+	appSettings *settings.AppSettings,
+) (*gokeepasslib.Database, string, error) {
+	remoteDB, err := decoder.decode(data, cred)
+	if err == nil {
+		return remoteDB, "", nil
+	}
+	if !isWrongCredentials(err) ||
+		appSettings.Passwords == nil ||
+		appSettings.DatabaseSettings.AuthMode == settings.KeyFileAuth {
+		return nil, "", err
+	}
+
+	log.Print("Remote Keepass DB can't be opened with the local password, asking for the remote one")
+	pass, err := appSettings.Passwords.PromptPassword()
+	if err != nil {
+		return nil, "", fmt.Errorf("can't get remote Keepass DB password: %w", err)
+	}
+	remoteDBSettings := *appSettings.DatabaseSettings
+	remoteDBSettings.Password = pass
+	remoteCred, err := newCredentials(&remoteDBSettings)
+	if err != nil {
+		return nil, "", err
+	}
+	remoteDB, err = decoder.decode(data, remoteCred)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return remoteDB, pass, nil
+}
+
+// isWrongCredentials tells decoding errors caused by a wrong composite key,
+// gokeepasslib doesn't export them so they are matched by text
+func isWrongCredentials(err error) bool {
+	return strings.HasPrefix(err.Error(), "Wrong password?")
+}
+
+// newCredentials builds the composite key of the database from the password and the key file
+func newCredentials(dbSettings *settings.DataBaseSettings) (*gokeepasslib.DBCredentials, error) {
+	if dbSettings.AuthMode == "" || dbSettings.AuthMode == settings.PasswordAuth {
+		return gokeepasslib.NewPasswordCredentials(dbSettings.Password), nil
+	}
+
+	keyData := dbSettings.KeyData
+	if keyData == nil {
+		var err error
+		keyData, err = os.ReadFile(dbSettings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read key file: %w", err)
+		}
+	}
+
+	var cred *gokeepasslib.DBCredentials
+	var err error
+	switch dbSettings.AuthMode {
+	case settings.KeyFileAuth:
+		cred, err = gokeepasslib.NewKeyDataCredentials(keyData)
+	case settings.PasswordAndKeyFileAuth:
+		cred, err = gokeepasslib.NewPasswordAndKeyDataCredentials(dbSettings.Password, keyData)
+	default:
+		return nil, fmt.Errorf("unknown auth mode: %s", dbSettings.AuthMode)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't parse key file: %w", err)
+	}
+
+	return cred, nil
+}
+
+// LoadBase decodes the snapshot of the last synced state which is used as a common ancestor for the merge
+func (keepassDBSync *DBSync) LoadBase(baseDBFileObj io.Reader) error {
+	data, err := io.ReadAll(baseDBFileObj)
+	if err != nil {
+		return fmt.Errorf("can't read base Keepass DB: %w", err)
+	}
+	// the snapshot keeps the master key of the last synced state which the remote base can still have
+	baseDB, err := keepassDBSync.decodeBase(data, keepassDBSync.localKeepassDB.Credentials)
+	if err != nil {
+		return fmt.Errorf("can't initialize base Keepass DB: %w", err)
+	}
+	keepassDBSync.baseKeepassDB = baseDB
+	keepassDBSync.merged = false
+
+	return nil
+}
+
+// decodeBase decodes a base with the first key of the sync which opens it, the preferred key is tried first,
+// then the local and the remote ones as a base written by another device can have either of them
+func (keepassDBSync *DBSync) decodeBase(
+	data []byte,
+	preferred *gokeepasslib.DBCredentials,
+) (*gokeepasslib.Database, error) {
+	creds := []*gokeepasslib.DBCredentials{preferred}
+	for _, cred := range []*gokeepasslib.DBCredentials{
+		keepassDBSync.localKeepassDB.Credentials,
+		keepassDBSync.remoteKeepassDBCopy.Credentials,
+	} {
+		if !slices.Contains(creds, cred) {
+			creds = append(creds, cred)
+		}
+	}
+
+	var err error
+	for _, cred := range creds {
+		var db *gokeepasslib.Database
+		db, err = keepassDBSync.decoder.decode(data, cred)
+		if err == nil || !isWrongCredentials(err) {
+			return db, err
+		}
+	}
+	return nil, err
+}
+
+// AddReplica decodes one more copy of the database which takes part in the sync,
+// the merge result is written back to its storage by Sync
+func (keepassDBSync *DBSync) AddReplica(name string, replicaDBFileObj io.Reader, storage Storage) error {
+	for _, replica := range keepassDBSync.replicas {
+		if replica.name == name {
+			return fmt.Errorf("replica %s is already added", name)
+		}
+	}
+	if name == localReplicaName || name == remoteReplicaName {
+		return fmt.Errorf("replica name %s is reserved", name)
+	}
+
+	data, err := io.ReadAll(replicaDBFileObj)
+	if err != nil {
+		return fmt.Errorf("can't read %s Keepass DB replica: %w", name, err)
+	}
+	// a replica synced by a device which changed the master password has the remote key
+	replicaDB, err := keepassDBSync.decodeBase(data, keepassDBSync.localKeepassDB.Credentials)
 	if err != nil {
-		return fmt.Errorf("can't open sync DB file: %w", err)
+		return fmt.Errorf("can't initialize %s Keepass DB replica: %w", name, err)
+	}
+	keepassDBSync.replicas = append(keepassDBSync.replicas, replica{
+		name:    name,
+		db:      replicaDB,
+		storage: storage,
+		size:    len(data),
+	})
+	keepassDBSync.merged = false
+
+	return nil
+}
+
+// remoteReplicas returns the remote base and all additional replicas sorted by name,
+// so the merge is done in the same order whatever order replicas were added in
+func (keepassDBSync *DBSync) remoteReplicas() []replica {
+	replicas := []replica{{
+		name:    remoteReplicaName,
+		db:      keepassDBSync.remoteKeepassDBCopy,
+		storage: keepassDBSync.storage,
+		size:    keepassDBSync.remoteSize,
+	}}
+	replicas = append(replicas, keepassDBSync.replicas...)
+	sort.SliceStable(replicas, func(i, j int) bool {
+		return replicas[i].name < replicas[j].name
+	})
+
+	return replicas
+}
+
+// SetConflictResolver replaces the conflict resolution strategy selected in settings
+func (keepassDBSync *DBSync) SetConflictResolver(resolver ConflictResolver) {
+	keepassDBSync.resolver = resolver
+	keepassDBSync.merged = false
+}
+
+// SetForce lets Sync write the merged DB even if it exceeds limits of the settings
+func (keepassDBSync *DBSync) SetForce(force bool) {
+	keepassDBSync.force = force
+}
+
+// Conflicts returns the number of conflicting versions stored in the conflicts group by the last merge
+func (keepassDBSync *DBSync) Conflicts() int {
+	return len(keepassDBSync.conflicts)
+}
+
+// WriteMerged merges all bases in memory and writes the encoded result, persisting it is up to the caller
+func (keepassDBSync *DBSync) WriteMerged(out io.Writer) error {
+	err := keepassDBSync.merge()
+	if err != nil {
+		return err
 	}
-	defer syncDBFileObj.Close()
 
 	err = keepassDBSync.syncKeepassDB.LockProtectedEntries()
 	if err != nil {
 		return err
 	}
-	keepassEncoder := gokeepasslib.NewEncoder(syncDBFileObj)
+	keepassEncoder := gokeepasslib.NewEncoder(out)
 	if err = keepassEncoder.Encode(keepassDBSync.syncKeepassDB); err != nil {
 		return fmt.Errorf("can't encode sync keepass DB: %w", err)
 	}
-	err = syncDBFileObj.Sync()
+	// the merged DB stays comparable with the bases
+	err = keepassDBSync.syncKeepassDB.UnlockProtectedEntries()
 	if err != nil {
-		return err
+		return fmt.Errorf("can't unlock protected entries: %w", err)
 	}
 
 	return nil
 }
 
-func (keepassDBSync *DBSync) syncBases() error {
-	localEntries := keepassDBSync.localKeepassDB.Content.Root.Groups[0].Entries
-	remoteCopyEntries := keepassDBSync.remoteKeepassDBCopy.Content.Root.Groups[0].Entries
+// Merged returns the encoded result of the merge of all bases
+func (keepassDBSync *DBSync) Merged() ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	err := keepassDBSync.WriteMerged(buffer)
+	if err != nil {
+		return nil, err
+	}
 
-	var missingInLocal []gokeepasslib.Entry
-	var missingInRemote []gokeepasslib.Entry
-	var newEntries []gokeepasslib.Entry
+	return buffer.Bytes(), nil
+}
 
-	// convert entries lists to maps to ease search by uuid
-	mapLocalEntries := make(map[string]gokeepasslib.Entry)
-	mapRemoteEntries := make(map[string]gokeepasslib.Entry)
-	for _, entry := range localEntries {
-		mapLocalEntries[fmt.Sprintf("%x", entry.UUID)] = entry
+// merge runs the merge once, Backup and Sync share its result
+func (keepassDBSync *DBSync) merge() error {
+	if keepassDBSync.merged {
+		return nil
 	}
-	for _, entry := range remoteCopyEntries {
-		mapRemoteEntries[fmt.Sprintf("%x", entry.UUID)] = entry
+	err := keepassDBSync.mergeBases()
+	if err != nil {
+		return err
 	}
+	keepassDBSync.merged = true
+	keepassDBSync.inSync = nil
 
-	// find missing entries in remote Keepass DB and for matching uuids find the latest modified version
-	for localKey, localValue := range mapLocalEntries {
-		remoteValue, ok := mapRemoteEntries[localKey]
-		if !ok {
-			missingInRemote = append(missingInRemote, localValue)
-		} else {
-			// TODO: need to check if LastModificationTime could be nil
-			if remoteValue.Times.LastModificationTime.Time.After(localValue.Times.LastModificationTime.Time) {
-				newEntries = append(newEntries, remoteValue)
-			} else {
-				newEntries = append(newEntries, localValue)
+	return nil
+}
+
+// mergeBases merges the local base and all replicas into the sync DB in memory
+func (keepassDBSync *DBSync) mergeBases() error {
+	replicas := keepassDBSync.remoteReplicas()
+	localTree := newTreeIndex(keepassDBSync.localKeepassDB.Content.Root)
+	replicaTrees := make([]*treeIndex, len(replicas))
+	for i, replica := range replicas {
+		replicaTrees[i] = newTreeIndex(replica.db.Content.Root)
+	}
+	// without a snapshot of the last synced state it falls back to a two-way merge
+	var baseTree *treeIndex
+	if keepassDBSync.baseKeepassDB != nil {
+		baseTree = newTreeIndex(keepassDBSync.baseKeepassDB.Content.Root)
+	}
+
+	// the format is chosen before attachments are pooled as their encoding depends on the KDBX version
+	headers := []*gokeepasslib.DBHeader{keepassDBSync.localKeepassDB.Header}
+	for _, replica := range replicas {
+		headers = append(headers, replica.db.Header)
+	}
+	format := outputFormat(keepassDBSync.settings.DatabaseSettings.OutputFormat, headers...)
+	// a forced version can change the KDF as well, KDBX 3.1 knows only AES-KDF
+	if forced := keepassDBSync.settings.DatabaseSettings.OutputFormat; forced.Version == "" && forced.KDF == "" {
+		for _, header := range headers {
+			if headerFormat := formatOf(header); headerFormat.KDF != format.KDF {
+				log.Printf(
+					"Warning: a base uses %s while the merged DB is written with %s, set KEEPASS_KDF to choose the KDF",
+					describeFormat(headerFormat),
+					describeFormat(format),
+				)
 			}
 		}
 	}
-	// find missing entries in local Keepass DB
-	for remoteKey, remoteValue := range mapRemoteEntries {
-		_, ok := mapLocalEntries[remoteKey]
-		if !ok {
-			missingInLocal = append(missingInLocal, remoteValue)
-		}
+	if localFormat := formatOf(keepassDBSync.localKeepassDB.Header); format != localFormat {
+		log.Printf("Keepass DB format changes from %s to %s", describeFormat(localFormat), describeFormat(format))
+	}
+	setHeader(keepassDBSync.syncKeepassDB, newHeader(format))
+
+	// database settings are merged first as history limits apply to the merged entries
+	for _, replica := range replicas {
+		mergeMeta(keepassDBSync.syncKeepassDB.Content.Meta, replica.db.Content.Meta)
 	}
-	// add missing entries
-	newEntries = append(newEntries, missingInLocal...)
-	newEntries = append(newEntries, missingInRemote...)
-	keepassDBSync.syncKeepassDB.Content.Root.Groups[0].Entries = newEntries
 
-	err := keepassDBSync.SaveSyncDB()
+	// attachments of all bases are moved to the sync DB binary pool
+	pool := newBinaryPool(keepassDBSync.syncKeepassDB)
+	err := pool.importTree(localTree, keepassDBSync.localKeepassDB)
 	if err != nil {
-		return fmt.Errorf("can't save new keepas DB: %w", err)
+		return fmt.Errorf("can't merge local attachments: %w", err)
+	}
+	for i, replica := range replicas {
+		err = pool.importTree(replicaTrees[i], replica.db)
+		if err != nil {
+			return fmt.Errorf("can't merge %s attachments: %w", replica.name, err)
+		}
+	}
+	if baseTree != nil {
+		err = pool.importTree(baseTree, keepassDBSync.baseKeepassDB)
+		if err != nil {
+			return fmt.Errorf("can't merge base attachments: %w", err)
+		}
 	}
 
+	// tombstones from all bases are honored and written into the sync DB
+	deletedObjects := keepassDBSync.localKeepassDB.Content.Root.DeletedObjects
+	customIcons := [][]gokeepasslib.CustomIcon{keepassDBSync.localKeepassDB.Content.Meta.CustomIcons}
+	for _, replica := range replicas {
+		deletedObjects = mergeDeletedObjects(deletedObjects, replica.db.Content.Root.DeletedObjects)
+		customIcons = append(customIcons, replica.db.Content.Meta.CustomIcons)
+	}
+
+	// replicas are folded into the local base one by one, the merge is driven by
+	// modification times so the result doesn't depend on which machine runs it
+	keepassDBSync.conflicts = nil
+	mergedTree := localTree
+	for i, replicaTree := range replicaTrees {
+		replicaBase := baseTree
+		// a replica which missed the last sync doesn't hold the snapshot,
+		// entries added while it was away would look deleted there
+		if keepassDBSync.syncedReplicas != nil && !keepassDBSync.syncedReplicas[replicas[i].name] {
+			replicaBase = nil
+		}
+		merger := &treeMerger{
+			base:           replicaBase,
+			local:          mergedTree,
+			remote:         replicaTree,
+			deletedObjects: deletedObjects,
+			meta:           keepassDBSync.syncKeepassDB.Content.Meta,
+			binarySizes:    pool.sizes,
+			resolver:       keepassDBSync.resolver,
+			device:         deviceName(),
+		}
+		mergedTree = merger.merge()
+		keepassDBSync.conflicts = append(keepassDBSync.conflicts, merger.conflictCopies...)
+	}
+	keepassDBSync.syncKeepassDB.Content.Root.Groups = mergedTree.build()
+	keepassDBSync.syncKeepassDB.Content.Root.DeletedObjects = deletedObjects
+	keepassDBSync.syncKeepassDB.Content.Meta.CustomIcons = mergeCustomIcons(
+		keepassDBSync.syncKeepassDB.Content.Root.Groups,
+		customIcons...,
+	)
+
 	return nil
 }
 
-func (keepassDBSync *DBSync) cleanLocal() error {
-	// check the recent backup first
-	// remove remote db copy
-	// remove original local db file
-	// rename tmp sync db file to original name
+// replaceLocal writes the merged DB over the local file once its backup is checked,
+// the replacement is recorded in the journal so an interrupted one can be recovered
+func (keepassDBSync *DBSync) replaceLocal(data []byte) error {
+	dbSettings := keepassDBSync.settings.DatabaseSettings
+	localData, err := os.ReadFile(dbSettings.FullFilePath())
+	if err != nil {
+		return fmt.Errorf("can't read local Keepass DB file: %w", err)
+	}
+	info, err := os.Stat(dbSettings.FullFilePath())
+	if err != nil {
+		return fmt.Errorf("can't get local Keepass BD file info: %w", err)
+	}
 
-	latestBackup, err := GetLatestBackup(keepassDBSync.settings.DatabaseSettings)
+	// on a retry the local file holds the result of the previous attempt,
+	// the journal keeps pointing at the backup made before the sync
+	previousJournal := keepassDBSync.journal
+	journal := &syncJournal{}
+	if previousJournal != nil {
+		*journal = *previousJournal
+	}
+	if previousJournal == nil || journal.Merged != hashOf(localData) {
+		latestBackup, err := GetLatestBackup(dbSettings)
+		if err != nil {
+			return err
+		}
+		backupPath := fmt.Sprintf("%s/%s", dbSettings.BackupDirectory, latestBackup.Name())
+
+		// checking checksum of the latest backup
+		isCheckSumsEqual, err := CompareFileCheckSums(dbSettings.FullFilePath(), backupPath)
+		if err != nil {
+			return fmt.Errorf("can't compare hashes: %w", err)
+		}
+
+		if !isCheckSumsEqual {
+			return errors.New("can't find latest backup")
+		}
+		journal = &syncJournal{Previous: hashOf(localData), Backup: backupPath}
+	}
+	journal.Stage = stageReplacing
+	journal.Merged = hashOf(data)
+	err = writeJournal(dbSettings, journal)
 	if err != nil {
 		return err
 	}
-
-	// checking checksum of the latest backup
-	isCheckSumsEqual, err := CompareFileCheckSums(
-		keepassDBSync.settings.DatabaseSettings.FullFilePath(),
-		fmt.Sprintf("%s/%s", keepassDBSync.settings.DatabaseSettings.BackupDirectory, latestBackup.Name()),
-	)
+	err = WriteFileAtomic(dbSettings.FullFilePath(), data, info.Mode().Perm())
 	if err != nil {
-		return fmt.Errorf("can't compare hashes: %w", err)
+		// the local file is untouched, a journal left behind would make the next run
+		// treat edits made to it meanwhile as a broken replacement
+		rollbackErr := keepassDBSync.rollbackJournal(previousJournal)
+		if rollbackErr != nil {
+			log.Printf("can't roll back sync journal: %v", rollbackErr)
+		}
+		return fmt.Errorf("can't replace local db file: %w", err)
 	}
+	keepassDBSync.journal = journal
+	journal.Stage = stageUploading
+
+	return writeJournal(dbSettings, journal)
+}
 
-	if !isCheckSumsEqual {
-		return errors.New("can't find latest backup")
+// rollbackJournal puts back the journal of the previous attempt or removes the journal of the first one
+func (keepassDBSync *DBSync) rollbackJournal(previousJournal *syncJournal) error {
+	dbSettings := keepassDBSync.settings.DatabaseSettings
+	if previousJournal == nil {
+		return removeJournal(dbSettings)
 	}
 
-	// deleting remote db copy
-	err = os.Remove(keepassDBSync.settings.DatabaseSettings.FullRemoteCopyFilePath())
+	return writeJournal(dbSettings, previousJournal)
+}
+
+// Sync writes the merge result over the local file and stored bases, bases which already hold it are skipped,
+// when a stored base is changed by another device meanwhile the bases which weren't written yet are downloaded
+// and merged again
+func (keepassDBSync *DBSync) Sync() error {
+	for attempt := 1; ; attempt++ {
+		err := keepassDBSync.syncOnce()
+		if !errors.Is(err, ErrRemoteChanged) {
+			return err
+		}
+		if attempt > maxRemoteChangeRetries {
+			return fmt.Errorf("stored bases keep changing, gave up after %d attempts: %w", attempt, err)
+		}
+		log.Printf("%v, merging bases again (%d/%d)", err, attempt, maxRemoteChangeRetries)
+		err = keepassDBSync.reloadBases()
+		if err != nil {
+			return err
+		}
+		// bases changed meanwhile are backed up, the local file is not as it holds the previous attempt
+		err = keepassDBSync.Backup()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (keepassDBSync *DBSync) syncOnce() error {
+	inSync, err := keepassDBSync.sidesInSync()
 	if err != nil {
-		return fmt.Errorf("can't remove remote copy: %w", err)
+		return fmt.Errorf("can't merge keepass DBs: %w", err)
+	}
+	dbSettings := keepassDBSync.settings.DatabaseSettings
+	if isEverySideInSync(inSync) {
+		log.Print("Keepass DBs are already in sync")
+		err = keepassDBSync.saveMissingSnapshot()
+		if err != nil {
+			return err
+		}
+		return keepassDBSync.saveSyncedReplicas()
 	}
-	// deleting original db file
-	err = os.Remove(keepassDBSync.settings.DatabaseSettings.FullFilePath())
+
+	data, err := keepassDBSync.Merged()
 	if err != nil {
-		return fmt.Errorf("can't delete local db file: %w", err)
+		return fmt.Errorf("can't merge keepass DBs: %w", err)
 	}
-	// renaming tmp sync file as original db file
-	err = os.Rename(
-		keepassDBSync.settings.DatabaseSettings.FullSyncFilePath(),
-		keepassDBSync.settings.DatabaseSettings.FullFilePath(),
-	)
+	err = keepassDBSync.verifyMerged(data)
+	if err != nil {
+		return fmt.Errorf("merged keepass DB failed verification: %w", err)
+	}
+	err = keepassDBSync.checkLimits(data)
+	if err != nil {
+		return err
+	}
+	if inSync[localReplicaName] {
+		log.Printf("%s base is already in sync", localReplicaName)
+	} else {
+		err = keepassDBSync.replaceLocal(data)
+		if err != nil {
+			return err
+		}
+		keepassDBSync.markWritten(localReplicaName)
+	}
+	// the local DB has the new master key from now on
+	if keepassDBSync.newPassword != "" {
+		err = keepassDBSync.settings.Passwords.SavePassword(keepassDBSync.newPassword)
+		if err != nil {
+			return fmt.Errorf("can't update stored password: %w", err)
+		}
+		dbSettings.Password = keepassDBSync.newPassword
+	}
+	if inSync[remoteReplicaName] {
+		log.Printf("%s base is already in sync", remoteReplicaName)
+	} else {
+		err = keepassDBSync.storage.UpdateDBFile(data)
+		if err != nil {
+			return fmt.Errorf("can't update remote base: %w", err)
+		}
+		keepassDBSync.markWritten(remoteReplicaName)
+	}
+	for _, replica := range keepassDBSync.replicas {
+		if inSync[replica.name] {
+			log.Printf("%s base is already in sync", replica.name)
+			continue
+		}
+		err = replica.storage.UpdateDBFile(data)
+		if err != nil {
+			return fmt.Errorf("can't update %s replica: %w", replica.name, err)
+		}
+		keepassDBSync.markWritten(replica.name)
+	}
+	// the snapshot is updated only after the upload, otherwise changes missing
+	// in the remote base would look like deletions on the next run
+	err = saveSnapshot(dbSettings, data)
 	if err != nil {
-		return fmt.Errorf("can't rename tmp sync file: %w", err)
+		return fmt.Errorf("can't save last synced state: %w", err)
 	}
+	// saved after the snapshot, a stale list only makes a replica merged without the snapshot
+	err = keepassDBSync.saveSyncedReplicas()
+	if err != nil {
+		return err
+	}
+
+	return removeJournal(dbSettings)
+}
+
+func (keepassDBSync *DBSync) markWritten(name string) {
+	if keepassDBSync.written == nil {
+		keepassDBSync.written = make(map[string]bool)
+	}
+	keepassDBSync.written[name] = true
+}
+
+// reloadBases downloads the bases which weren't written by this sync again, the local base and the bases
+// which were written keep their versions from before the sync, so the snapshot stays their common ancestor
+// and changes taken from a base by the previous attempt don't look like changes of both sides
+func (keepassDBSync *DBSync) reloadBases() error {
+	// a base written by another device can have the key of the merge result or any of the keys of the sync
+	cred := keepassDBSync.syncKeepassDB.Credentials
+	if !keepassDBSync.written[remoteReplicaName] {
+		remoteData, err := downloadBase(keepassDBSync.storage)
+		if err != nil {
+			return fmt.Errorf("can't download remote Keepass DB file: %w", err)
+		}
+		remoteDB, err := keepassDBSync.decodeBase(remoteData, cred)
+		if err != nil {
+			return fmt.Errorf("can't initialize remote Keepass DB copy: %w", err)
+		}
+		keepassDBSync.remoteKeepassDBCopy = remoteDB
+		keepassDBSync.remoteSize = len(remoteData)
+	}
+	for i := range keepassDBSync.replicas {
+		replica := &keepassDBSync.replicas[i]
+		if keepassDBSync.written[replica.name] {
+			continue
+		}
+		data, err := downloadBase(replica.storage)
+		if err != nil {
+			return fmt.Errorf("can't open %s replica: %w", replica.name, err)
+		}
+		replica.db, err = keepassDBSync.decodeBase(data, cred)
+		if err != nil {
+			return fmt.Errorf("can't initialize %s Keepass DB replica: %w", replica.name, err)
+		}
+		replica.size = len(data)
+	}
+
+	// the merge result keeps the master key chosen by the first attempt, it's already saved
+	syncDB := cloneDatabase(keepassDBSync.localKeepassDB)
+	syncDB.Credentials = cred
+	syncDB.Content.Meta.MasterKeyChanged = copyTime(keepassDBSync.syncKeepassDB.Content.Meta.MasterKeyChanged)
+	keepassDBSync.syncKeepassDB = syncDB
+	keepassDBSync.newPassword = ""
+	keepassDBSync.merged = false
 
 	return nil
 }
 
-func (keepassDBSync *DBSync) Sync() error {
-	err := keepassDBSync.syncBases()
+func downloadBase(storage Storage) ([]byte, error) {
+	dbObj, err := storage.DownloadRemoteKeepassDB()
 	if err != nil {
+		return nil, err
+	}
+	defer dbObj.Close()
+
+	return io.ReadAll(dbObj)
+}
+
+// saveMissingSnapshot keeps the last synced state when bases were already in sync before the first run
+func (keepassDBSync *DBSync) saveMissingSnapshot() error {
+	dbSettings := keepassDBSync.settings.DatabaseSettings
+	_, err := os.Stat(dbSettings.FullSnapshotFilePath())
+	if !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
-	err = keepassDBSync.cleanLocal()
+	data, err := keepassDBSync.Merged()
 	if err != nil {
-		return err
+		return fmt.Errorf("can't merge keepass DBs: %w", err)
 	}
-	err = keepassDBSync.storage.UpdateDBFile()
+	err = saveSnapshot(dbSettings, data)
+	if err != nil {
+		return fmt.Errorf("can't save last synced state: %w", err)
+	}
+
+	return nil
+}
+
+// saveSyncedReplicas records which bases hold the snapshot, replicas skipped by this sync are left out
+func (keepassDBSync *DBSync) saveSyncedReplicas() error {
+	var names []string
+	for _, side := range keepassDBSync.sides() {
+		names = append(names, side.name)
+	}
+	data, err := json.Marshal(names)
 	if err != nil {
 		return err
 	}
+	err = WriteFileAtomic(keepassDBSync.settings.DatabaseSettings.FullSyncedReplicasFilePath(), data, 0600)
+	if err != nil {
+		return fmt.Errorf("can't save replicas of last synced state: %w", err)
+	}
 
 	return nil
 }
 
-func (keepassDBSync *DBSync) Backup() error {
-	err := backupLocalKeepassDB(keepassDBSync.settings.DatabaseSettings)
+// loadSyncedReplicas reads the bases updated by the last sync, the list is missing
+// when the snapshot was saved by an older version, then every base is taken as synced
+func loadSyncedReplicas(dbSettings *settings.DataBaseSettings) (map[string]bool, error) {
+	data, err := os.ReadFile(dbSettings.FullSyncedReplicasFilePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	err = json.Unmarshal(data, &names)
 	if err != nil {
-		return fmt.Errorf("can't create backup: %w", err)
+		return nil, err
+	}
+	synced := make(map[string]bool)
+	for _, name := range names {
+		synced[name] = true
 	}
-	err = keepassDBSync.storage.BackupDBFile()
+
+	return synced, nil
+}
+
+func isEverySideInSync(inSync map[string]bool) bool {
+	for _, equal := range inSync {
+		if !equal {
+			return false
+		}
+	}
+	return true
+}
+
+// Backup copies bases which are going to be changed by Sync
+func (keepassDBSync *DBSync) Backup() error {
+	inSync, err := keepassDBSync.sidesInSync()
 	if err != nil {
-		return fmt.Errorf("can't backup remote base: %w", err)
+		return fmt.Errorf("can't merge keepass DBs: %w", err)
+	}
+	// the backup made before the first attempt of the sync is kept, the journal points at it
+	if !inSync[localReplicaName] && keepassDBSync.journal == nil {
+		err = backupLocalKeepassDB(keepassDBSync.settings.DatabaseSettings)
+		if err != nil {
+			return fmt.Errorf("can't create backup: %w", err)
+		}
+	}
+	// bases written by an earlier attempt hold its result, they were backed up before it
+	if !inSync[remoteReplicaName] && !keepassDBSync.written[remoteReplicaName] {
+		err = keepassDBSync.storage.BackupDBFile()
+		if err != nil {
+			return fmt.Errorf("can't backup remote base: %w", err)
+		}
+	}
+	for _, replica := range keepassDBSync.replicas {
+		if inSync[replica.name] || keepassDBSync.written[replica.name] {
+			continue
+		}
+		err = replica.storage.BackupDBFile()
+		if err != nil {
+			return fmt.Errorf("can't backup %s replica: %w", replica.name, err)
+		}
 	}
 
 	return nil
@@ -270,56 +854,132 @@ func backupLocalKeepassDB(dbSettings *settings.DataBaseSettings) error {
 	return nil
 }
 
-func InitKeepassDBSync(settings *settings.AppSettings, storage Storage) (*DBSync, error) {
-	localKeepassDBPath := settings.DatabaseSettings.FullFilePath()
-
-	localKeepassDBObj, err := os.Open(localKeepassDBPath)
-	if err != nil {
-		return nil, fmt.Errorf("can't open local Keepass DB file: %w", err)
+func deviceName() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "unknown device"
 	}
-	defer localKeepassDBObj.Close()
+	return hostname
+}
 
-	err = storage.DownloadRemoteKeepassDB()
+func saveSnapshot(dbSettings *settings.DataBaseSettings, data []byte) error {
+	err := os.MkdirAll(dbSettings.StateDirectory, 0700)
 	if err != nil {
-		return nil, fmt.Errorf("can't download remote Keepass DB file: %w", err)
+		return fmt.Errorf("can't create state directory: %w", err)
 	}
-
-	remoteDBCopyObj, err := os.Open(settings.DatabaseSettings.FullRemoteCopyFilePath())
+	err = WriteFileAtomic(dbSettings.FullSnapshotFilePath(), data, 0600)
 	if err != nil {
-		return nil, fmt.Errorf("can't open remote DB copy: %w", err)
+		return fmt.Errorf("can't write a snapshot file: %w", err)
 	}
-	defer remoteDBCopyObj.Close()
 
-	syncDBObj, err := os.Create(settings.DatabaseSettings.FullSyncFilePath())
+	return nil
+}
+
+// InitKeepassDBSync locks the database for the whole sync, the lock is released by Close
+func InitKeepassDBSync(settings *settings.AppSettings, storage Storage, replicas ...ReplicaStorage) (*DBSync, error) {
+	return lockKeepassDBSync(settings, AcquireSyncLock, RecoverInterruptedSync, storage, replicas...)
+}
+
+// InitKeepassDBDryRun opens the bases like InitKeepassDBSync, but an interrupted sync is only reported
+// as a dry run must not touch the local file, it's recovered by the next sync, the lock is taken only
+// when the state directory already exists, so a dry run creates neither the directory nor the lock file
+func InitKeepassDBDryRun(settings *settings.AppSettings, storage Storage, replicas ...ReplicaStorage) (*DBSync, error) {
+	return lockKeepassDBSync(settings, acquireExistingSyncLock, reportInterruptedSync, storage, replicas...)
+}
+
+func lockKeepassDBSync(
+	settings *settings.AppSettings,
+	acquireLock func(dbSettings *settings.DataBaseSettings) (*SyncLock, error),
+	recoverSync func(dbSettings *settings.DataBaseSettings) error,
+	storage Storage,
+	replicas ...ReplicaStorage,
+) (*DBSync, error) {
+	lock, err := acquireLock(settings.DatabaseSettings)
 	if err != nil {
-		return nil, fmt.Errorf("can't create sync db file: %w", err)
+		return nil, err
 	}
-	defer syncDBObj.Close()
-	_, err = io.Copy(syncDBObj, localKeepassDBObj)
+	err = recoverSync(settings.DatabaseSettings)
 	if err != nil {
-		return nil, fmt.Errorf("can't copy local db file to sync db file: %w", err)
+		lock.Release()
+		return nil, err
 	}
-	err = syncDBObj.Sync()
+	keepasSync, err := initKeepassDBSync(settings, storage, replicas...)
 	if err != nil {
+		lock.Release()
 		return nil, err
 	}
-	_, err = syncDBObj.Seek(0, 0)
+	keepasSync.lock = lock
+
+	return keepasSync, nil
+}
+
+// Close releases the lock of the database taken by InitKeepassDBSync
+func (keepassDBSync *DBSync) Close() error {
+	return keepassDBSync.lock.Release()
+}
+
+func initKeepassDBSync(settings *settings.AppSettings, storage Storage, replicas ...ReplicaStorage) (*DBSync, error) {
+	localKeepassDBPath := settings.DatabaseSettings.FullFilePath()
+
+	localKeepassDBObj, err := os.Open(localKeepassDBPath)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("can't open local Keepass DB file: %w", err)
 	}
-	_, err = localKeepassDBObj.Seek(0, 0)
+	defer localKeepassDBObj.Close()
+
+	remoteDBCopyObj, err := storage.DownloadRemoteKeepassDB()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("can't download remote Keepass DB file: %w", err)
 	}
+	defer remoteDBCopyObj.Close()
 
-	keepasSync, err := NewKeepassDBSync(localKeepassDBObj, remoteDBCopyObj, syncDBObj, storage, settings)
+	keepasSync, err := NewKeepassDBSync(localKeepassDBObj, remoteDBCopyObj, storage, settings)
 	if err != nil {
 		return nil, fmt.Errorf("can't open one of Keepass DBs: %w", err)
 	}
 
+	for _, replicaStorage := range replicas {
+		err = addReplicaStorage(keepasSync, replicaStorage)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	baseDBObj, err := os.Open(settings.DatabaseSettings.FullSnapshotFilePath())
+	if err == nil {
+		defer baseDBObj.Close()
+		err = keepasSync.LoadBase(baseDBObj)
+		if err != nil {
+			log.Printf("Unable to load last synced state, falling back to two-way merge: %v", err)
+		}
+		keepasSync.syncedReplicas, err = loadSyncedReplicas(settings.DatabaseSettings)
+		if err != nil {
+			log.Printf("Unable to load replicas of last synced state, merging them without it: %v", err)
+			keepasSync.syncedReplicas = map[string]bool{localReplicaName: true}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("can't open last synced state: %w", err)
+	}
+
 	return keepasSync, nil
 }
 
+// addReplicaStorage reads a replica, replicas which are not available at the moment
+// (e.g. an unmounted USB stick) are skipped
+func addReplicaStorage(keepasSync *DBSync, replicaStorage ReplicaStorage) error {
+	replicaDBObj, err := replicaStorage.DownloadRemoteKeepassDB()
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("Replica %s is not available, skipping it: %v", replicaStorage.Name(), err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't open %s replica: %w", replicaStorage.Name(), err)
+	}
+	defer replicaDBObj.Close()
+
+	return keepasSync.AddReplica(replicaStorage.Name(), replicaDBObj, replicaStorage)
+}
+
 func CompareFileCheckSums(filePath1 string, filePath2 string) (bool, error) {
 	f1, err := os.Open(filePath1)
 	if err != nil {
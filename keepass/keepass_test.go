@@ -2,28 +2,86 @@ package keepass_test
 
 import (
 	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"kdbxsync/keepass"
 	"kdbxsync/settings"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/tobischo/gokeepasslib/v3"
 	w "github.com/tobischo/gokeepasslib/v3/wrappers"
 )
 
 // storage fake
-type fakeStorage struct{}
+type fakeStorage struct {
+	data    []byte
+	err     error
+	updates int
+	backups int
+	// versions uploaded by other devices right before the next updates
+	changes [][]byte
+}
 
-func (storage *fakeStorage) UpdateDBFile() error {
+func (storage *fakeStorage) UpdateDBFile(data []byte) error {
+	if storage.err != nil {
+		return storage.err
+	}
+	if len(storage.changes) > 0 {
+		storage.data = storage.changes[0]
+		storage.changes = storage.changes[1:]
+		return keepass.ErrRemoteChanged
+	}
+	storage.data = data
+	storage.updates++
 	return nil
 }
 
-func (storage *fakeStorage) DownloadRemoteKeepassDB() error {
-	return nil
+func (storage *fakeStorage) DownloadRemoteKeepassDB() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(storage.data)), nil
 }
 
 func (storage *fakeStorage) BackupDBFile() error {
+	storage.backups++
+	return nil
+}
+
+// replica storage fake, a replica without data is not mounted
+type fakeReplicaStorage struct {
+	fakeStorage
+	name string
+}
+
+func (storage *fakeReplicaStorage) Name() string {
+	return storage.name
+}
+
+func (storage *fakeReplicaStorage) DownloadRemoteKeepassDB() (io.ReadCloser, error) {
+	if storage.data == nil {
+		return nil, os.ErrNotExist
+	}
+	return storage.fakeStorage.DownloadRemoteKeepassDB()
+}
+
+// password provider fake
+type fakePasswords struct {
+	password string
+	saved    string
+	prompts  int
+}
+
+func (passwords *fakePasswords) PromptPassword() (string, error) {
+	passwords.prompts++
+	return passwords.password, nil
+}
+
+func (passwords *fakePasswords) SavePassword(pass string) error {
+	passwords.saved = pass
 	return nil
 }
 
@@ -76,22 +134,86 @@ func TestNewKeepassDBSync(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		localDBFileObj := &bytes.Buffer{}
 		remoteDBCopyFileObj := &bytes.Buffer{}
-		tmpSyncFileObj := &bytes.Buffer{}
 
 		keepassBase := newFakeKeepassDatabase()
 
 		gokeepasslib.NewEncoder(localDBFileObj).Encode(keepassBase)
 		gokeepasslib.NewEncoder(remoteDBCopyFileObj).Encode(keepassBase)
-		gokeepasslib.NewEncoder(tmpSyncFileObj).Encode(keepassBase)
 
 		storage := &fakeStorage{}
 		dbSettings := settings.DataBaseSettings{
-			Directory:        "/test/directory",
-			FileName:         "testfile.kdbx",
-			Password:         "pass",
-			RemoteCopyPrefix: "remote",
-			SyncDBName:       "tmp.kdbx",
-			BackupDirectory:  "backups",
+			Directory:       "/test/directory",
+			FileName:        "testfile.kdbx",
+			Password:        "pass",
+			BackupDirectory: "backups",
+		}
+		settings := &settings.AppSettings{
+			HTTPServer:         &FakeHTTPServer{},
+			DatabaseSettings:   &dbSettings,
+			StorageCredentials: "pass",
+		}
+
+		dbSync, err := keepass.NewKeepassDBSync(localDBFileObj, remoteDBCopyFileObj, storage, settings)
+
+		assert.NoError(t, err)
+		assert.NotNil(t, dbSync)
+	})
+
+	t.Run("success: password and key file", func(t *testing.T) {
+		keyFilePath := filepath.Join(t.TempDir(), "testfile.key")
+		keyData := []byte("arbitrary binary key file content")
+		require.NoError(t, os.WriteFile(keyFilePath, keyData, 0600))
+
+		keepassBase := newFakeKeepassDatabase()
+		cred, err := gokeepasslib.NewPasswordAndKeyDataCredentials("pass", keyData)
+		require.NoError(t, err)
+		keepassBase.Credentials = cred
+		dbFileObj := &bytes.Buffer{}
+		require.NoError(t, gokeepasslib.NewEncoder(dbFileObj).Encode(keepassBase))
+		data := dbFileObj.Bytes()
+
+		dbSettings := settings.DataBaseSettings{
+			Directory:       "/test/directory",
+			FileName:        "testfile.kdbx",
+			Password:        "pass",
+			BackupDirectory: "backups",
+			AuthMode:        settings.PasswordAndKeyFileAuth,
+			KeyFile:         keyFilePath,
+		}
+		settings := &settings.AppSettings{
+			HTTPServer:         &FakeHTTPServer{},
+			DatabaseSettings:   &dbSettings,
+			StorageCredentials: "pass",
+		}
+
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(data),
+			bytes.NewReader(data),
+			&fakeStorage{},
+			settings,
+		)
+
+		assert.NoError(t, err)
+		assert.NotNil(t, dbSync)
+	})
+
+	t.Run("success: key file from the secret store", func(t *testing.T) {
+		keyData := []byte("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+		keepassBase := newFakeKeepassDatabase()
+		cred, err := gokeepasslib.NewKeyDataCredentials(keyData)
+		require.NoError(t, err)
+		keepassBase.Credentials = cred
+		dbFileObj := &bytes.Buffer{}
+		require.NoError(t, gokeepasslib.NewEncoder(dbFileObj).Encode(keepassBase))
+		data := dbFileObj.Bytes()
+
+		dbSettings := settings.DataBaseSettings{
+			Directory:       "/test/directory",
+			FileName:        "testfile.kdbx",
+			BackupDirectory: "backups",
+			AuthMode:        settings.KeyFileAuth,
+			KeyData:         keyData,
 		}
 		settings := &settings.AppSettings{
 			HTTPServer:         &FakeHTTPServer{},
@@ -99,31 +221,54 @@ func TestNewKeepassDBSync(t *testing.T) {
 			StorageCredentials: "pass",
 		}
 
-		dbSync, err := keepass.NewKeepassDBSync(localDBFileObj, remoteDBCopyFileObj, tmpSyncFileObj, storage, settings)
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(data),
+			bytes.NewReader(data),
+			&fakeStorage{},
+			settings,
+		)
 
 		assert.NoError(t, err)
 		assert.NotNil(t, dbSync)
 	})
 
+	t.Run("error: missing key file", func(t *testing.T) {
+		dbSettings := settings.DataBaseSettings{
+			Directory:       "/test/directory",
+			FileName:        "testfile.kdbx",
+			Password:        "pass",
+			BackupDirectory: "backups",
+			AuthMode:        settings.PasswordAndKeyFileAuth,
+			KeyFile:         filepath.Join(t.TempDir(), "missing.key"),
+		}
+		settings := &settings.AppSettings{
+			HTTPServer:         &FakeHTTPServer{},
+			DatabaseSettings:   &dbSettings,
+			StorageCredentials: "pass",
+		}
+
+		dbSync, err := keepass.NewKeepassDBSync(&bytes.Buffer{}, &bytes.Buffer{}, &fakeStorage{}, settings)
+
+		assert.Error(t, err)
+		assert.Nil(t, dbSync)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
 	t.Run("error: wrong keepass database password", func(t *testing.T) {
 		localDBFileObj := &bytes.Buffer{}
 		remoteDBCopyFileObj := &bytes.Buffer{}
-		tmpSyncFileObj := &bytes.Buffer{}
 
 		keepassBase := newFakeKeepassDatabase()
 
 		gokeepasslib.NewEncoder(localDBFileObj).Encode(keepassBase)
 		gokeepasslib.NewEncoder(remoteDBCopyFileObj).Encode(keepassBase)
-		gokeepasslib.NewEncoder(tmpSyncFileObj).Encode(keepassBase)
 
 		storage := &fakeStorage{}
 		dbSettings := settings.DataBaseSettings{
-			Directory:        "/test/directory",
-			FileName:         "testfile.kdbx",
-			Password:         "",
-			RemoteCopyPrefix: "remote",
-			SyncDBName:       "tmp.kdbx",
-			BackupDirectory:  "backups",
+			Directory:       "/test/directory",
+			FileName:        "testfile.kdbx",
+			Password:        "",
+			BackupDirectory: "backups",
 		}
 		settings := &settings.AppSettings{
 			HTTPServer:         &FakeHTTPServer{},
@@ -131,7 +276,7 @@ func TestNewKeepassDBSync(t *testing.T) {
 			StorageCredentials: "pass",
 		}
 
-		dbSync, err := keepass.NewKeepassDBSync(localDBFileObj, remoteDBCopyFileObj, tmpSyncFileObj, storage, settings)
+		dbSync, err := keepass.NewKeepassDBSync(localDBFileObj, remoteDBCopyFileObj, storage, settings)
 
 		assert.Error(t, err)
 		assert.Nil(t, dbSync)
@@ -142,3 +287,480 @@ func TestNewKeepassDBSync(t *testing.T) {
 		)
 	})
 }
+
+func TestNewKeepassDBSyncDecrypts(t *testing.T) {
+	t.Run("success: identical files are decrypted once", func(t *testing.T) {
+		data := encodeTestDatabase(t, newFakeKeepassDatabase())
+		appSettings := newTestSettings(t)
+
+		dbSync, err := keepass.NewKeepassDBSync(bytes.NewReader(data), bytes.NewReader(data), &fakeStorage{}, appSettings)
+		require.NoError(t, err)
+		require.NoError(t, dbSync.LoadBase(bytes.NewReader(data)))
+		require.NoError(t, dbSync.AddReplica("nas", bytes.NewReader(data), &fakeStorage{}))
+		mergedData, err := dbSync.Merged()
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, dbSync.Decrypted())
+		syncDB := gokeepasslib.NewDatabase()
+		syncDB.Credentials = gokeepasslib.NewPasswordCredentials("pass")
+		require.NoError(t, gokeepasslib.NewDecoder(bytes.NewReader(mergedData)).Decode(syncDB))
+		require.NoError(t, syncDB.UnlockProtectedEntries())
+		entries := syncDB.Content.Root.Groups[0].Entries
+		require.Len(t, entries, 1)
+		assert.Equal(t, "pass1", entries[0].GetPassword())
+	})
+
+	t.Run("success: different files are decrypted separately", func(t *testing.T) {
+		localData := encodeTestDatabase(t, newFakeKeepassDatabase())
+		remoteData := encodeTestDatabase(t, newFakeKeepassDatabase())
+
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(localData),
+			bytes.NewReader(remoteData),
+			&fakeStorage{},
+			newTestSettings(t),
+		)
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, dbSync.Decrypted())
+	})
+}
+
+func TestNewKeepassDBSyncRemoteCredentials(t *testing.T) {
+	encodeWithPassword := func(t *testing.T, password string, masterKeyChanged time.Time) []byte {
+		keepassBase := newFakeKeepassDatabase()
+		keepassBase.Credentials = gokeepasslib.NewPasswordCredentials(password)
+		changed := w.Now()
+		changed.Time = masterKeyChanged
+		keepassBase.Content.Meta.MasterKeyChanged = &changed
+		buffer := &bytes.Buffer{}
+		require.NoError(t, keepassBase.LockProtectedEntries())
+		require.NoError(t, gokeepasslib.NewEncoder(buffer).Encode(keepassBase))
+		return buffer.Bytes()
+	}
+	decodeMerged := func(t *testing.T, dbSync *keepass.DBSync, password string) error {
+		data, err := dbSync.Merged()
+		require.NoError(t, err)
+		syncDB := gokeepasslib.NewDatabase()
+		syncDB.Credentials = gokeepasslib.NewPasswordCredentials(password)
+		return gokeepasslib.NewDecoder(bytes.NewReader(data)).Decode(syncDB)
+	}
+
+	t.Run("success: newer remote master key is used for the result", func(t *testing.T) {
+		localData := encodeWithPassword(t, "pass", baseTime)
+		remoteData := encodeWithPassword(t, "new pass", baseTime.Add(time.Hour))
+		appSettings := newTestSettings(t)
+		appSettings.Passwords = &fakePasswords{password: "new pass"}
+
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(localData),
+			bytes.NewReader(remoteData),
+			&fakeStorage{},
+			appSettings,
+		)
+		require.NoError(t, err)
+
+		assert.NoError(t, decodeMerged(t, dbSync, "new pass"))
+	})
+
+	t.Run("success: newer local master key is kept", func(t *testing.T) {
+		localData := encodeWithPassword(t, "pass", baseTime.Add(time.Hour))
+		remoteData := encodeWithPassword(t, "old pass", baseTime)
+		appSettings := newTestSettings(t)
+		appSettings.Passwords = &fakePasswords{password: "old pass"}
+
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(localData),
+			bytes.NewReader(remoteData),
+			&fakeStorage{},
+			appSettings,
+		)
+		require.NoError(t, err)
+
+		assert.NoError(t, decodeMerged(t, dbSync, "pass"))
+	})
+
+	t.Run("success: replica with the remote master key is opened", func(t *testing.T) {
+		localData := encodeWithPassword(t, "pass", baseTime)
+		remoteData := encodeWithPassword(t, "new pass", baseTime.Add(time.Hour))
+		appSettings := newTestSettings(t)
+		appSettings.Passwords = &fakePasswords{password: "new pass"}
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(localData),
+			bytes.NewReader(remoteData),
+			&fakeStorage{},
+			appSettings,
+		)
+		require.NoError(t, err)
+
+		err = dbSync.AddReplica("nas", bytes.NewReader(remoteData), &fakeStorage{data: remoteData})
+
+		require.NoError(t, err)
+		assert.NoError(t, decodeMerged(t, dbSync, "new pass"))
+	})
+
+	t.Run("success: remote changed during the sync keeps its old master key", func(t *testing.T) {
+		appSettings := newTestSettings(t)
+		dbSettings := appSettings.DatabaseSettings
+		dbSettings.BackupDirectory = filepath.Join(dbSettings.Directory, "backups")
+		dbSettings.StateDirectory = filepath.Join(dbSettings.Directory, ".kdbxsync")
+		localData := encodeWithPassword(t, "pass", baseTime.Add(time.Hour))
+		require.NoError(t, os.WriteFile(dbSettings.FullFilePath(), localData, 0600))
+		// another device still on the old password uploads a new version before the upload of this sync
+		remoteStorage := &fakeStorage{
+			data:    encodeWithPassword(t, "old pass", baseTime),
+			changes: [][]byte{encodeWithPassword(t, "old pass", baseTime)},
+		}
+		passwords := &fakePasswords{password: "old pass"}
+		appSettings.Passwords = passwords
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(localData),
+			bytes.NewReader(remoteStorage.data),
+			remoteStorage,
+			appSettings,
+		)
+		require.NoError(t, err)
+		require.NoError(t, dbSync.Backup())
+
+		require.NoError(t, dbSync.Sync())
+
+		assert.Equal(t, 1, remoteStorage.updates)
+		assert.Equal(t, 1, passwords.prompts)
+		syncDB := gokeepasslib.NewDatabase()
+		syncDB.Credentials = gokeepasslib.NewPasswordCredentials("pass")
+		assert.NoError(t, gokeepasslib.NewDecoder(bytes.NewReader(remoteStorage.data)).Decode(syncDB))
+	})
+
+	t.Run("error: remote password is unknown", func(t *testing.T) {
+		localData := encodeWithPassword(t, "pass", baseTime)
+		remoteData := encodeWithPassword(t, "new pass", baseTime.Add(time.Hour))
+		appSettings := newTestSettings(t)
+		appSettings.Passwords = &fakePasswords{password: "wrong pass"}
+
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(localData),
+			bytes.NewReader(remoteData),
+			&fakeStorage{},
+			appSettings,
+		)
+
+		assert.Error(t, err)
+		assert.Nil(t, dbSync)
+		assert.Equal(
+			t,
+			"can't initialize remote Keepass DB copy: Wrong password? Database integrity check failed",
+			err.Error(),
+		)
+	})
+}
+
+func TestSync(t *testing.T) {
+	t.Run("success: merged DB replaces local file and stored bases", func(t *testing.T) {
+		remote := newFakeKeepassDatabase()
+		root := &remote.Content.Root.Groups[0]
+		root.Entries = append(root.Entries, mkEntry(gokeepasslib.NewUUID(), "Local", "local", baseTime))
+		localData := encodeTestDatabase(t, remote)
+		root.Entries[1] = mkEntry(gokeepasslib.NewUUID(), "Remote", "remote", baseTime)
+		appSettings := newTestSettings(t)
+		dbSettings := appSettings.DatabaseSettings
+		dbSettings.BackupDirectory = filepath.Join(dbSettings.Directory, "backups")
+		dbSettings.StateDirectory = filepath.Join(dbSettings.Directory, ".kdbxsync")
+		require.NoError(t, os.WriteFile(dbSettings.FullFilePath(), localData, 0600))
+		remoteStorage := &fakeStorage{data: encodeTestDatabase(t, remote)}
+		replicaStorage := &fakeStorage{data: localData}
+
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(localData),
+			bytes.NewReader(remoteStorage.data),
+			remoteStorage,
+			appSettings,
+		)
+		require.NoError(t, err)
+		require.NoError(t, dbSync.AddReplica("nas", bytes.NewReader(replicaStorage.data), replicaStorage))
+		require.NoError(t, dbSync.Backup())
+		require.NoError(t, dbSync.Sync())
+
+		data, err := os.ReadFile(dbSettings.FullFilePath())
+		require.NoError(t, err)
+		assert.Equal(t, data, remoteStorage.data)
+		assert.Equal(t, data, replicaStorage.data)
+		snapshot, err := os.ReadFile(dbSettings.FullSnapshotFilePath())
+		require.NoError(t, err)
+		assert.Equal(t, data, snapshot)
+		syncDB := gokeepasslib.NewDatabase()
+		syncDB.Credentials = gokeepasslib.NewPasswordCredentials("pass")
+		require.NoError(t, gokeepasslib.NewDecoder(bytes.NewReader(data)).Decode(syncDB))
+		assert.Len(t, syncDB.Content.Root.Groups[0].Entries, 3)
+		// nothing but the DB, backups and the state is left in the directory
+		files, err := os.ReadDir(dbSettings.Directory)
+		require.NoError(t, err)
+		var names []string
+		for _, file := range files {
+			names = append(names, file.Name())
+		}
+		assert.ElementsMatch(t, []string{".kdbxsync", "backups", "testfile.kdbx"}, names)
+	})
+}
+
+func TestSyncAlreadyInSync(t *testing.T) {
+	newSync := func(
+		t *testing.T,
+		local *gokeepasslib.Database,
+		remote *gokeepasslib.Database,
+	) (*keepass.DBSync, *settings.DataBaseSettings, *fakeStorage) {
+		appSettings := newTestSettings(t)
+		dbSettings := appSettings.DatabaseSettings
+		dbSettings.BackupDirectory = filepath.Join(dbSettings.Directory, "backups")
+		dbSettings.StateDirectory = filepath.Join(dbSettings.Directory, ".kdbxsync")
+		localData := encodeTestDatabase(t, local)
+		require.NoError(t, os.WriteFile(dbSettings.FullFilePath(), localData, 0600))
+		remoteStorage := &fakeStorage{data: encodeTestDatabase(t, remote)}
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(localData),
+			bytes.NewReader(remoteStorage.data),
+			remoteStorage,
+			appSettings,
+		)
+		require.NoError(t, err)
+		return dbSync, dbSettings, remoteStorage
+	}
+
+	t.Run("success: nothing is written when bases are equal", func(t *testing.T) {
+		db := newFakeKeepassDatabase()
+		dbSync, dbSettings, remoteStorage := newSync(t, db, db)
+		localData, err := os.ReadFile(dbSettings.FullFilePath())
+		require.NoError(t, err)
+		remoteData := remoteStorage.data
+
+		require.NoError(t, dbSync.Backup())
+		require.NoError(t, dbSync.Sync())
+
+		data, err := os.ReadFile(dbSettings.FullFilePath())
+		require.NoError(t, err)
+		assert.Equal(t, localData, data)
+		assert.Equal(t, remoteData, remoteStorage.data)
+		assert.Zero(t, remoteStorage.updates)
+		assert.Zero(t, remoteStorage.backups)
+		_, err = os.Stat(dbSettings.BackupDirectory)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		// the first run still keeps the last synced state
+		_, err = os.Stat(dbSettings.FullSnapshotFilePath())
+		assert.NoError(t, err)
+	})
+
+	t.Run("success: only the base behind is written", func(t *testing.T) {
+		remote := newFakeKeepassDatabase()
+		remoteData := encodeTestDatabase(t, remote)
+		remote.Content.Root.Groups[0].Entries = append(
+			remote.Content.Root.Groups[0].Entries,
+			mkEntry(gokeepasslib.NewUUID(), "Local", "local", baseTime),
+		)
+		appSettings := newTestSettings(t)
+		dbSettings := appSettings.DatabaseSettings
+		dbSettings.BackupDirectory = filepath.Join(dbSettings.Directory, "backups")
+		dbSettings.StateDirectory = filepath.Join(dbSettings.Directory, ".kdbxsync")
+		localData := encodeTestDatabase(t, remote)
+		require.NoError(t, os.WriteFile(dbSettings.FullFilePath(), localData, 0600))
+		remoteStorage := &fakeStorage{data: remoteData}
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(localData),
+			bytes.NewReader(remoteData),
+			remoteStorage,
+			appSettings,
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, dbSync.Backup())
+		require.NoError(t, dbSync.Sync())
+
+		data, err := os.ReadFile(dbSettings.FullFilePath())
+		require.NoError(t, err)
+		assert.Equal(t, localData, data)
+		_, err = os.Stat(dbSettings.BackupDirectory)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		assert.Equal(t, 1, remoteStorage.updates)
+		assert.Equal(t, 1, remoteStorage.backups)
+		syncDB := gokeepasslib.NewDatabase()
+		syncDB.Credentials = gokeepasslib.NewPasswordCredentials("pass")
+		require.NoError(t, gokeepasslib.NewDecoder(bytes.NewReader(remoteStorage.data)).Decode(syncDB))
+		assert.Len(t, syncDB.Content.Root.Groups[0].Entries, 2)
+	})
+
+	t.Run("success: forced format rewrites equal bases", func(t *testing.T) {
+		db := newFakeKeepassDatabase()
+		dbSync, _, remoteStorage := newSync(t, db, db)
+		dbSync.SetOutputFormat(settings.OutputFormat{Version: settings.KDBX4})
+
+		require.NoError(t, dbSync.Backup())
+		require.NoError(t, dbSync.Sync())
+
+		assert.Equal(t, 1, remoteStorage.updates)
+	})
+}
+
+func TestSyncRemoteChanged(t *testing.T) {
+	newSync := func(t *testing.T, changes int) (*keepass.DBSync, *settings.DataBaseSettings, *fakeStorage, []byte) {
+		remote := newFakeKeepassDatabase()
+		root := &remote.Content.Root.Groups[0]
+		root.Entries = append(root.Entries, mkEntry(gokeepasslib.NewUUID(), "Local", "local", baseTime))
+		localData := encodeTestDatabase(t, remote)
+		root.Entries[1] = mkEntry(gokeepasslib.NewUUID(), "Remote", "remote", baseTime)
+		remoteStorage := &fakeStorage{data: encodeTestDatabase(t, remote)}
+		for i := 0; i < changes; i++ {
+			other := mkEntry(gokeepasslib.NewUUID(), fmt.Sprintf("Other %d", i), "other", baseTime)
+			root.Entries = append(root.Entries, other)
+			remoteStorage.changes = append(remoteStorage.changes, encodeTestDatabase(t, remote))
+		}
+		appSettings := newTestSettings(t)
+		dbSettings := appSettings.DatabaseSettings
+		dbSettings.BackupDirectory = filepath.Join(dbSettings.Directory, "backups")
+		dbSettings.StateDirectory = filepath.Join(dbSettings.Directory, ".kdbxsync")
+		require.NoError(t, os.WriteFile(dbSettings.FullFilePath(), localData, 0600))
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(localData),
+			bytes.NewReader(remoteStorage.data),
+			remoteStorage,
+			appSettings,
+		)
+		require.NoError(t, err)
+		require.NoError(t, dbSync.Backup())
+		return dbSync, dbSettings, remoteStorage, localData
+	}
+
+	t.Run("success: changed remote base is merged again", func(t *testing.T) {
+		dbSync, dbSettings, remoteStorage, localData := newSync(t, 1)
+
+		require.NoError(t, dbSync.Sync())
+
+		data, err := os.ReadFile(dbSettings.FullFilePath())
+		require.NoError(t, err)
+		assert.Equal(t, data, remoteStorage.data)
+		syncDB := gokeepasslib.NewDatabase()
+		syncDB.Credentials = gokeepasslib.NewPasswordCredentials("pass")
+		require.NoError(t, gokeepasslib.NewDecoder(bytes.NewReader(data)).Decode(syncDB))
+		var titles []string
+		for _, entry := range syncDB.Content.Root.Groups[0].Entries {
+			titles = append(titles, entry.GetTitle())
+		}
+		assert.ElementsMatch(t, []string{"My pass", "Local", "Remote", "Other 0"}, titles)
+		// the changed remote base is backed up before it's replaced
+		assert.Equal(t, 2, remoteStorage.backups)
+		// the local file made by the first attempt doesn't replace its backup made before the sync
+		backups, err := os.ReadDir(dbSettings.BackupDirectory)
+		require.NoError(t, err)
+		backedUp := false
+		for _, backup := range backups {
+			data, err := os.ReadFile(filepath.Join(dbSettings.BackupDirectory, backup.Name()))
+			require.NoError(t, err)
+			backedUp = backedUp || bytes.Equal(data, localData)
+		}
+		assert.True(t, backedUp, "local file before the sync is missing in backups")
+		_, err = os.Stat(dbSettings.FullJournalFilePath())
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("success: entry changed again on the remote is not a conflict", func(t *testing.T) {
+		entryID := gokeepasslib.NewUUID()
+		newBase := func(password string, modified time.Time) *gokeepasslib.Database {
+			db := newFakeKeepassDatabase()
+			root := &db.Content.Root.Groups[0]
+			root.Entries = append(root.Entries, mkEntry(entryID, "X", password, modified))
+			return db
+		}
+		snapshot := encodeTestDatabase(t, newBase("a", baseTime))
+		localData := snapshot
+		remoteStorage := &fakeStorage{
+			data:    encodeTestDatabase(t, newBase("b", baseTime.Add(time.Hour))),
+			changes: [][]byte{encodeTestDatabase(t, newBase("c", baseTime.Add(2*time.Hour)))},
+		}
+		appSettings := newTestSettings(t)
+		dbSettings := appSettings.DatabaseSettings
+		dbSettings.BackupDirectory = filepath.Join(dbSettings.Directory, "backups")
+		dbSettings.StateDirectory = filepath.Join(dbSettings.Directory, ".kdbxsync")
+		require.NoError(t, os.WriteFile(dbSettings.FullFilePath(), localData, 0600))
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(localData),
+			bytes.NewReader(remoteStorage.data),
+			remoteStorage,
+			appSettings,
+		)
+		require.NoError(t, err)
+		require.NoError(t, dbSync.LoadBase(bytes.NewReader(snapshot)))
+		require.NoError(t, dbSync.Backup())
+
+		require.NoError(t, dbSync.Sync())
+
+		assert.Zero(t, dbSync.Conflicts())
+		data, err := os.ReadFile(dbSettings.FullFilePath())
+		require.NoError(t, err)
+		assert.Equal(t, data, remoteStorage.data)
+		syncDB := gokeepasslib.NewDatabase()
+		syncDB.Credentials = gokeepasslib.NewPasswordCredentials("pass")
+		require.NoError(t, gokeepasslib.NewDecoder(bytes.NewReader(data)).Decode(syncDB))
+		require.NoError(t, syncDB.UnlockProtectedEntries())
+		passwords := make(map[string]string)
+		for _, entry := range syncDB.Content.Root.Groups[0].Entries {
+			passwords[entry.GetTitle()] = entry.GetPassword()
+		}
+		assert.Equal(t, map[string]string{"My pass": "pass1", "X": "c"}, passwords)
+		assert.Nil(t, findGroup(syncDB.Content.Root.Groups, "Sync Conflicts"))
+	})
+
+	t.Run("error: remote base keeps changing", func(t *testing.T) {
+		dbSync, _, remoteStorage, _ := newSync(t, 4)
+
+		err := dbSync.Sync()
+
+		assert.ErrorIs(t, err, keepass.ErrRemoteChanged)
+		assert.ErrorContains(t, err, "stored bases keep changing, gave up after 4 attempts")
+		assert.Zero(t, remoteStorage.updates)
+	})
+}
+
+func TestSyncSkippedReplica(t *testing.T) {
+	t.Run("success: entries added while a replica was away are kept", func(t *testing.T) {
+		appSettings := newTestSettings(t)
+		dbSettings := appSettings.DatabaseSettings
+		dbSettings.BackupDirectory = filepath.Join(dbSettings.Directory, "backups")
+		dbSettings.StateDirectory = filepath.Join(dbSettings.Directory, ".kdbxsync")
+		db := newFakeKeepassDatabase()
+		data := encodeTestDatabase(t, db)
+		require.NoError(t, os.WriteFile(dbSettings.FullFilePath(), data, 0600))
+		remoteStorage := &fakeStorage{data: data}
+		usb := &fakeReplicaStorage{fakeStorage: fakeStorage{data: data}, name: "usb"}
+		sync := func(replicas ...keepass.ReplicaStorage) {
+			dbSync, err := keepass.InitKeepassDBSync(appSettings, remoteStorage, replicas...)
+			require.NoError(t, err)
+			defer dbSync.Close()
+			require.NoError(t, dbSync.Backup())
+			require.NoError(t, dbSync.Sync())
+		}
+		titles := func(data []byte) []string {
+			syncDB := gokeepasslib.NewDatabase()
+			syncDB.Credentials = gokeepasslib.NewPasswordCredentials("pass")
+			require.NoError(t, gokeepasslib.NewDecoder(bytes.NewReader(data)).Decode(syncDB))
+			var titles []string
+			for _, entry := range syncDB.Content.Root.Groups[0].Entries {
+				titles = append(titles, entry.GetTitle())
+			}
+			return titles
+		}
+
+		// all bases are in sync, then an entry is added while the usb replica is unplugged
+		sync(usb)
+		root := &db.Content.Root.Groups[0]
+		root.Entries = append(root.Entries, mkEntry(gokeepasslib.NewUUID(), "Added", "added", baseTime))
+		require.NoError(t, os.WriteFile(dbSettings.FullFilePath(), encodeTestDatabase(t, db), 0600))
+		usbData := usb.data
+		usb.data = nil
+		sync(usb)
+		usb.data = usbData
+		sync(usb)
+
+		assert.ElementsMatch(t, []string{"My pass", "Added"}, titles(remoteStorage.data))
+		assert.ElementsMatch(t, []string{"My pass", "Added"}, titles(usb.data))
+		local, err := os.ReadFile(dbSettings.FullFilePath())
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"My pass", "Added"}, titles(local))
+	})
+}
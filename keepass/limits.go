@@ -0,0 +1,76 @@
+package keepass
+
+import (
+	"errors"
+	"fmt"
+)
+
+// limits used when they are not set in settings
+const (
+	defaultMaxDeletedEntries = 20
+	defaultMaxDeletedPercent = 50
+	defaultMaxShrinkPercent  = 50
+)
+
+// ErrSyncLimit is returned by Sync when the merged DB loses more than the limits of the settings allow
+var ErrSyncLimit = errors.New("sync limit exceeded")
+
+// checkLimits compares the merged DB with every base, a truncated or an empty base merged by mistake
+// shows up as a lot of entries lost at once or as a much smaller file
+func (keepassDBSync *DBSync) checkLimits(data []byte) error {
+	if keepassDBSync.force {
+		return nil
+	}
+	limits := keepassDBSync.settings.DatabaseSettings.Limits
+	maxDeletedEntries := firstPositive(limits.MaxDeletedEntries, defaultMaxDeletedEntries)
+	maxDeletedPercent := firstPositive(limits.MaxDeletedPercent, defaultMaxDeletedPercent)
+	maxShrinkPercent := firstPositive(limits.MaxShrinkPercent, defaultMaxShrinkPercent)
+
+	merged := contentOf(keepassDBSync.syncKeepassDB).entries
+	for _, side := range keepassDBSync.sides() {
+		entries := contentOf(side.db).entries
+		if len(entries) > 0 && len(merged) == 0 {
+			return fmt.Errorf("%w: merged DB is empty, %s base has %d entries", ErrSyncLimit, side.name, len(entries))
+		}
+		var lost uint64
+		for id := range entries {
+			if merged[id] == 0 {
+				lost++
+			}
+		}
+		if lost > maxDeletedEntries {
+			return fmt.Errorf(
+				"%w: merged DB loses %d of %d entries of %s base, the limit is %d entries",
+				ErrSyncLimit,
+				lost,
+				len(entries),
+				side.name,
+				maxDeletedEntries,
+			)
+		}
+		if lost*100 > uint64(len(entries))*maxDeletedPercent {
+			return fmt.Errorf(
+				"%w: merged DB loses %d%% of entries of %s base (%d of %d), the limit is %d%%",
+				ErrSyncLimit,
+				lost*100/uint64(len(entries)),
+				side.name,
+				lost,
+				len(entries),
+				maxDeletedPercent,
+			)
+		}
+		if len(data) < side.size && uint64(side.size-len(data))*100 > uint64(side.size)*maxShrinkPercent {
+			return fmt.Errorf(
+				"%w: merged DB of %d bytes is %d%% smaller than %s base of %d bytes, the limit is %d%%",
+				ErrSyncLimit,
+				len(data),
+				(side.size-len(data))*100/side.size,
+				side.name,
+				side.size,
+				maxShrinkPercent,
+			)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package keepass_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kdbxsync/keepass"
+	"kdbxsync/settings"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+func TestSyncLimits(t *testing.T) {
+	rootID := gokeepasslib.NewUUID()
+	var entryIDs []gokeepasslib.UUID
+	for i := 0; i < 30; i++ {
+		entryIDs = append(entryIDs, gokeepasslib.NewUUID())
+	}
+	// newBase creates a base with the first count entries
+	newBase := func(count int) *gokeepasslib.Database {
+		root := mkGroup(rootID, "Root", baseTime)
+		for i, id := range entryIDs[:count] {
+			root.Entries = append(root.Entries, mkEntry(id, fmt.Sprintf("Entry %d", i), "pass", baseTime))
+		}
+		return newTestDatabase(root)
+	}
+	// newSync prepares a three-way sync, entries missing in the remote base are deleted by the merge
+	newSync := func(
+		t *testing.T,
+		base *gokeepasslib.Database,
+		local *gokeepasslib.Database,
+		remote *gokeepasslib.Database,
+	) (*keepass.DBSync, *settings.DataBaseSettings, *fakeStorage) {
+		appSettings := newTestSettings(t)
+		dbSettings := appSettings.DatabaseSettings
+		dbSettings.BackupDirectory = filepath.Join(dbSettings.Directory, "backups")
+		dbSettings.StateDirectory = filepath.Join(dbSettings.Directory, ".kdbxsync")
+		localData := encodeTestDatabase(t, local)
+		require.NoError(t, os.WriteFile(dbSettings.FullFilePath(), localData, 0600))
+		remoteStorage := &fakeStorage{data: encodeTestDatabase(t, remote)}
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(localData),
+			bytes.NewReader(remoteStorage.data),
+			remoteStorage,
+			appSettings,
+		)
+		require.NoError(t, err)
+		require.NoError(t, dbSync.LoadBase(bytes.NewReader(encodeTestDatabase(t, base))))
+		require.NoError(t, dbSync.Backup())
+		return dbSync, dbSettings, remoteStorage
+	}
+	assertRefused := func(
+		t *testing.T,
+		dbSync *keepass.DBSync,
+		dbSettings *settings.DataBaseSettings,
+		remoteStorage *fakeStorage,
+		message string,
+	) {
+		localData, err := os.ReadFile(dbSettings.FullFilePath())
+		require.NoError(t, err)
+		remoteData := remoteStorage.data
+
+		err = dbSync.Sync()
+
+		assert.ErrorIs(t, err, keepass.ErrSyncLimit)
+		assert.EqualError(t, err, message)
+		// nothing is written when the sync is refused
+		data, err := os.ReadFile(dbSettings.FullFilePath())
+		require.NoError(t, err)
+		assert.Equal(t, localData, data)
+		assert.Equal(t, remoteData, remoteStorage.data)
+	}
+
+	t.Run("success: deletions within limits", func(t *testing.T) {
+		dbSync, _, remoteStorage := newSync(t, newBase(4), newBase(4), newBase(2))
+
+		require.NoError(t, dbSync.Sync())
+
+		syncDB := gokeepasslib.NewDatabase()
+		syncDB.Credentials = gokeepasslib.NewPasswordCredentials("pass")
+		require.NoError(t, gokeepasslib.NewDecoder(bytes.NewReader(remoteStorage.data)).Decode(syncDB))
+		assert.Len(t, syncDB.Content.Root.Groups[0].Entries, 2)
+	})
+
+	t.Run("error: merged DB is empty", func(t *testing.T) {
+		dbSync, dbSettings, remoteStorage := newSync(t, newBase(2), newBase(2), newBase(0))
+
+		assertRefused(t, dbSync, dbSettings, remoteStorage, "sync limit exceeded: merged DB is empty, local base has 2 entries")
+	})
+
+	t.Run("error: too many entries are lost", func(t *testing.T) {
+		dbSync, dbSettings, remoteStorage := newSync(t, newBase(30), newBase(30), newBase(5))
+
+		assertRefused(
+			t,
+			dbSync,
+			dbSettings,
+			remoteStorage,
+			"sync limit exceeded: merged DB loses 25 of 30 entries of local base, the limit is 20 entries",
+		)
+	})
+
+	t.Run("error: too big part of entries is lost", func(t *testing.T) {
+		dbSync, dbSettings, remoteStorage := newSync(t, newBase(4), newBase(4), newBase(1))
+
+		assertRefused(
+			t,
+			dbSync,
+			dbSettings,
+			remoteStorage,
+			"sync limit exceeded: merged DB loses 75% of entries of local base (3 of 4), the limit is 50%",
+		)
+	})
+
+	t.Run("error: limits from settings", func(t *testing.T) {
+		dbSync, dbSettings, remoteStorage := newSync(t, newBase(10), newBase(10), newBase(7))
+		dbSettings.Limits = settings.SyncLimits{MaxDeletedEntries: 2}
+
+		assertRefused(
+			t,
+			dbSync,
+			dbSettings,
+			remoteStorage,
+			"sync limit exceeded: merged DB loses 3 of 10 entries of local base, the limit is 2 entries",
+		)
+	})
+
+	t.Run("error: merged DB is much smaller", func(t *testing.T) {
+		withAttachment := func(count int) *gokeepasslib.Database {
+			db := newBase(count)
+			content := make([]byte, 64*1024)
+			_, err := rand.Read(content)
+			require.NoError(t, err)
+			key := db.AddBinary(content)
+			entry := &db.Content.Root.Groups[0].Entries[count-1]
+			entry.Binaries = append(entry.Binaries, key.CreateReference("backup.bin"))
+			return db
+		}
+		dbSync, dbSettings, remoteStorage := newSync(t, withAttachment(2), withAttachment(2), newBase(1))
+
+		localData, err := os.ReadFile(dbSettings.FullFilePath())
+		require.NoError(t, err)
+		remoteData := remoteStorage.data
+
+		err = dbSync.Sync()
+
+		assert.ErrorIs(t, err, keepass.ErrSyncLimit)
+		assert.ErrorContains(t, err, fmt.Sprintf("smaller than local base of %d bytes, the limit is 50%%", len(localData)))
+		assert.Equal(t, remoteData, remoteStorage.data)
+	})
+
+	t.Run("success: forced sync ignores limits", func(t *testing.T) {
+		dbSync, _, remoteStorage := newSync(t, newBase(2), newBase(2), newBase(0))
+		dbSync.SetForce(true)
+
+		require.NoError(t, dbSync.Sync())
+
+		syncDB := gokeepasslib.NewDatabase()
+		syncDB.Credentials = gokeepasslib.NewPasswordCredentials("pass")
+		require.NoError(t, gokeepasslib.NewDecoder(bytes.NewReader(remoteStorage.data)).Decode(syncDB))
+		assert.Empty(t, syncDB.Content.Root.Groups[0].Entries)
+	})
+}
@@ -0,0 +1,138 @@
+package keepass
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"kdbxsync/settings"
+)
+
+// how often a waiting run checks whether the lock is released
+const lockRetryInterval = 100 * time.Millisecond
+
+// SyncLock keeps other kdbxsync runs away from the database until it's released,
+// the lock file holds the PID of the run owning it
+type SyncLock struct {
+	fileObj *os.File
+}
+
+// AcquireSyncLock takes the lock of the database, when another run holds it the lock is retried
+// until the timeout of the settings is over, the lock of a killed run is released by the OS
+func AcquireSyncLock(dbSettings *settings.DataBaseSettings) (*SyncLock, error) {
+	err := os.MkdirAll(dbSettings.StateDirectory, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("can't create state directory: %w", err)
+	}
+	lockPath := dbSettings.FullLockFilePath()
+	fileObj, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("can't open lock file: %w", err)
+	}
+
+	deadline := time.Now().Add(dbSettings.LockTimeout)
+	for {
+		err = syscall.Flock(int(fileObj.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			fileObj.Close()
+			return nil, fmt.Errorf("can't lock %s: %w", lockPath, err)
+		}
+		if time.Now().After(deadline) {
+			pid := lockOwner(fileObj)
+			fileObj.Close()
+			if pid > 0 && !isProcessAlive(pid) {
+				return nil, fmt.Errorf("lock file %s is still held, but its kdbxsync run (pid %d) is gone", lockPath, pid)
+			}
+			return nil, fmt.Errorf("another kdbxsync run (pid %d) is syncing the database, lock file %s", pid, lockPath)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+
+	// a released lock is emptied, so a PID left in the file belongs to a run which was killed
+	if pid := lockOwner(fileObj); pid > 0 {
+		log.Printf("Previous kdbxsync run (pid %d) didn't release the lock, it's stale", pid)
+	}
+	err = writeLockOwner(fileObj, strconv.Itoa(os.Getpid()))
+	if err != nil {
+		fileObj.Close()
+		return nil, fmt.Errorf("can't write lock file: %w", err)
+	}
+
+	return &SyncLock{fileObj: fileObj}, nil
+}
+
+// acquireExistingSyncLock takes the lock like AcquireSyncLock, but only when the state directory exists,
+// so a dry run of a database which was never synced creates nothing, without the directory the lock is nil
+// and nothing can race the dry run as it doesn't write anything
+func acquireExistingSyncLock(dbSettings *settings.DataBaseSettings) (*SyncLock, error) {
+	_, err := os.Stat(dbSettings.StateDirectory)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read state directory: %w", err)
+	}
+
+	return AcquireSyncLock(dbSettings)
+}
+
+// Release empties the lock file and unlocks it, the file itself is kept
+// as removing it would let two runs lock different files
+func (lock *SyncLock) Release() error {
+	if lock == nil || lock.fileObj == nil {
+		return nil
+	}
+	defer func() { lock.fileObj = nil }()
+
+	err := writeLockOwner(lock.fileObj, "")
+	if err != nil {
+		lock.fileObj.Close()
+		return fmt.Errorf("can't write lock file: %w", err)
+	}
+	err = syscall.Flock(int(lock.fileObj.Fd()), syscall.LOCK_UN)
+	if err != nil {
+		lock.fileObj.Close()
+		return fmt.Errorf("can't unlock lock file: %w", err)
+	}
+
+	return lock.fileObj.Close()
+}
+
+// lockOwner reads the PID written to the lock file, it's 0 when the file is empty
+func lockOwner(fileObj *os.File) int {
+	data, err := io.ReadAll(io.NewSectionReader(fileObj, 0, 32))
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+func writeLockOwner(fileObj *os.File, owner string) error {
+	err := fileObj.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = fileObj.WriteAt([]byte(owner), 0)
+	if err != nil {
+		return err
+	}
+	return fileObj.Sync()
+}
+
+func isProcessAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
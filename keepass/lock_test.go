@@ -0,0 +1,109 @@
+package keepass_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"kdbxsync/keepass"
+	"kdbxsync/settings"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncLock(t *testing.T) {
+	newSettings := func(t *testing.T) *settings.DataBaseSettings {
+		dbSettings := newTestSettings(t).DatabaseSettings
+		dbSettings.StateDirectory = filepath.Join(dbSettings.Directory, ".kdbxsync")
+		return dbSettings
+	}
+
+	t.Run("success: lock holds the pid and is emptied on release", func(t *testing.T) {
+		dbSettings := newSettings(t)
+
+		lock, err := keepass.AcquireSyncLock(dbSettings)
+
+		require.NoError(t, err)
+		data, err := os.ReadFile(dbSettings.FullLockFilePath())
+		require.NoError(t, err)
+		assert.Equal(t, strconv.Itoa(os.Getpid()), string(data))
+		require.NoError(t, lock.Release())
+		data, err = os.ReadFile(dbSettings.FullLockFilePath())
+		require.NoError(t, err)
+		assert.Empty(t, data)
+	})
+
+	t.Run("success: released lock is taken again", func(t *testing.T) {
+		dbSettings := newSettings(t)
+		lock, err := keepass.AcquireSyncLock(dbSettings)
+		require.NoError(t, err)
+		require.NoError(t, lock.Release())
+
+		lock, err = keepass.AcquireSyncLock(dbSettings)
+
+		require.NoError(t, err)
+		assert.NoError(t, lock.Release())
+	})
+
+	t.Run("success: lock left by a killed run is stale", func(t *testing.T) {
+		dbSettings := newSettings(t)
+		require.NoError(t, os.MkdirAll(dbSettings.StateDirectory, 0700))
+		require.NoError(t, os.WriteFile(dbSettings.FullLockFilePath(), []byte("999999999"), 0600))
+
+		lock, err := keepass.AcquireSyncLock(dbSettings)
+
+		require.NoError(t, err)
+		assert.NoError(t, lock.Release())
+	})
+
+	t.Run("success: waiting run gets the lock once it's released", func(t *testing.T) {
+		dbSettings := newSettings(t)
+		lock, err := keepass.AcquireSyncLock(dbSettings)
+		require.NoError(t, err)
+		dbSettings.LockTimeout = 10 * time.Second
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			lock.Release()
+		}()
+
+		waiting, err := keepass.AcquireSyncLock(dbSettings)
+
+		require.NoError(t, err)
+		assert.NoError(t, waiting.Release())
+	})
+
+	t.Run("error: lock is held by another run", func(t *testing.T) {
+		dbSettings := newSettings(t)
+		lock, err := keepass.AcquireSyncLock(dbSettings)
+		require.NoError(t, err)
+		defer lock.Release()
+		dbSettings.LockTimeout = 300 * time.Millisecond
+		started := time.Now()
+
+		_, err = keepass.AcquireSyncLock(dbSettings)
+
+		assert.EqualError(t, err, fmt.Sprintf(
+			"another kdbxsync run (pid %d) is syncing the database, lock file %s",
+			os.Getpid(),
+			dbSettings.FullLockFilePath(),
+		))
+		assert.GreaterOrEqual(t, time.Since(started), dbSettings.LockTimeout)
+	})
+
+	t.Run("error: sync is not started while the database is locked", func(t *testing.T) {
+		appSettings := newTestSettings(t)
+		dbSettings := appSettings.DatabaseSettings
+		dbSettings.StateDirectory = filepath.Join(dbSettings.Directory, ".kdbxsync")
+		lock, err := keepass.AcquireSyncLock(dbSettings)
+		require.NoError(t, err)
+		defer lock.Release()
+
+		_, err = keepass.InitKeepassDBSync(appSettings, &fakeStorage{})
+
+		assert.ErrorContains(t, err, "another kdbxsync run")
+	})
+}
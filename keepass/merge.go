@@ -0,0 +1,590 @@
+package keepass
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// conflictsGroupName is the group under the root group which keeps versions of entries that couldn't be merged
+const conflictsGroupName = "Sync Conflicts"
+
+type groupRecord struct {
+	// group without its child entries and groups
+	group  gokeepasslib.Group
+	parent gokeepasslib.UUID
+}
+
+type entryRecord struct {
+	entry  gokeepasslib.Entry
+	parent gokeepasslib.UUID
+}
+
+// treeIndex is a flat view of a Keepass DB group tree to ease search by uuid
+type treeIndex struct {
+	rootUUID   gokeepasslib.UUID
+	groups     map[gokeepasslib.UUID]groupRecord
+	groupOrder []gokeepasslib.UUID
+	entries    map[gokeepasslib.UUID]entryRecord
+	entryOrder []gokeepasslib.UUID
+}
+
+func newEmptyTreeIndex(rootUUID gokeepasslib.UUID) *treeIndex {
+	return &treeIndex{
+		rootUUID: rootUUID,
+		groups:   make(map[gokeepasslib.UUID]groupRecord),
+		entries:  make(map[gokeepasslib.UUID]entryRecord),
+	}
+}
+
+func newTreeIndex(root *gokeepasslib.RootData) *treeIndex {
+	var rootUUID gokeepasslib.UUID
+	if len(root.Groups) > 0 {
+		rootUUID = root.Groups[0].UUID
+	}
+	index := newEmptyTreeIndex(rootUUID)
+	for i := range root.Groups {
+		index.addGroup(&root.Groups[i], gokeepasslib.UUID{})
+	}
+
+	return index
+}
+
+func (index *treeIndex) addGroup(group *gokeepasslib.Group, parent gokeepasslib.UUID) {
+	record := groupRecord{group: *group, parent: parent}
+	record.group.Entries = nil
+	record.group.Groups = nil
+	index.putGroup(group.UUID, record)
+
+	for i := range group.Entries {
+		index.putEntry(group.Entries[i].UUID, entryRecord{entry: copyEntry(group.Entries[i]), parent: group.UUID})
+	}
+	for i := range group.Groups {
+		index.addGroup(&group.Groups[i], group.UUID)
+	}
+}
+
+func (index *treeIndex) putGroup(id gokeepasslib.UUID, record groupRecord) {
+	if _, ok := index.groups[id]; !ok {
+		index.groupOrder = append(index.groupOrder, id)
+	}
+	index.groups[id] = record
+}
+
+func (index *treeIndex) putEntry(id gokeepasslib.UUID, record entryRecord) {
+	if _, ok := index.entries[id]; !ok {
+		index.entryOrder = append(index.entryOrder, id)
+	}
+	index.entries[id] = record
+}
+
+func (index *treeIndex) removeGroup(id gokeepasslib.UUID) {
+	delete(index.groups, id)
+	index.groupOrder = removeUUID(index.groupOrder, id)
+}
+
+func (index *treeIndex) removeEntry(id gokeepasslib.UUID) {
+	delete(index.entries, id)
+	index.entryOrder = removeUUID(index.entryOrder, id)
+}
+
+// aliasRoot makes the root group of the index share the uuid of another root group,
+// every Keepass DB has exactly one root group so they always match
+func (index *treeIndex) aliasRoot(rootUUID gokeepasslib.UUID) {
+	if index.rootUUID == rootUUID {
+		return
+	}
+	oldRootUUID := index.rootUUID
+	index.rootUUID = rootUUID
+
+	if record, ok := index.groups[oldRootUUID]; ok {
+		delete(index.groups, oldRootUUID)
+		record.group.UUID = rootUUID
+		index.groups[rootUUID] = record
+		for i, id := range index.groupOrder {
+			if id == oldRootUUID {
+				index.groupOrder[i] = rootUUID
+			}
+		}
+	}
+	for id, record := range index.groups {
+		if record.parent == oldRootUUID {
+			record.parent = rootUUID
+			index.groups[id] = record
+		}
+	}
+	for id, record := range index.entries {
+		if record.parent == oldRootUUID {
+			record.parent = rootUUID
+			index.entries[id] = record
+		}
+	}
+}
+
+// fixParents moves groups and entries with a missing parent to the root group
+// and breaks group cycles which can appear after merging moves made on both sides
+func (index *treeIndex) fixParents() {
+	var zeroUUID gokeepasslib.UUID
+	_, hasRoot := index.groups[index.rootUUID]
+
+	for _, id := range index.groupOrder {
+		record := index.groups[id]
+		if id == index.rootUUID {
+			record.parent = zeroUUID
+		} else if _, ok := index.groups[record.parent]; !ok && record.parent != zeroUUID {
+			record.parent = index.rootUUID
+		}
+		if record.parent == index.rootUUID && !hasRoot {
+			record.parent = zeroUUID
+		}
+		index.groups[id] = record
+	}
+
+	for _, id := range index.groupOrder {
+		seen := map[gokeepasslib.UUID]bool{id: true}
+		for parent := index.groups[id].parent; parent != zeroUUID; parent = index.groups[parent].parent {
+			if seen[parent] {
+				record := index.groups[id]
+				record.parent = index.rootUUID
+				index.groups[id] = record
+				break
+			}
+			seen[parent] = true
+		}
+	}
+
+	for _, id := range index.entryOrder {
+		record := index.entries[id]
+		if _, ok := index.groups[record.parent]; !ok {
+			record.parent = index.rootUUID
+			index.entries[id] = record
+		}
+	}
+}
+
+// build assembles the group tree back from the index
+func (index *treeIndex) build() []gokeepasslib.Group {
+	index.fixParents()
+
+	childGroups := make(map[gokeepasslib.UUID][]gokeepasslib.UUID)
+	for _, id := range index.groupOrder {
+		parent := index.groups[id].parent
+		childGroups[parent] = append(childGroups[parent], id)
+	}
+	childEntries := make(map[gokeepasslib.UUID][]gokeepasslib.Entry)
+	for _, id := range index.entryOrder {
+		record := index.entries[id]
+		childEntries[record.parent] = append(childEntries[record.parent], record.entry)
+	}
+
+	var buildGroup func(id gokeepasslib.UUID) gokeepasslib.Group
+	buildGroup = func(id gokeepasslib.UUID) gokeepasslib.Group {
+		group := index.groups[id].group
+		group.Entries = childEntries[id]
+		for _, childID := range childGroups[id] {
+			group.Groups = append(group.Groups, buildGroup(childID))
+		}
+		return group
+	}
+
+	var groups []gokeepasslib.Group
+	for _, id := range childGroups[gokeepasslib.UUID{}] {
+		groups = append(groups, buildGroup(id))
+	}
+
+	return groups
+}
+
+type mergeChoice int
+
+const (
+	chooseNone mergeChoice = iota
+	chooseLocal
+	chooseRemote
+	// modified on both sides since the last sync
+	chooseConflict
+)
+
+// chooseVersion decides which version of a group or entry survives the merge,
+// base is the version from the last synced state, nil means the object is missing there
+func chooseVersion(base *gokeepasslib.TimeData, local *gokeepasslib.TimeData, remote *gokeepasslib.TimeData) mergeChoice {
+	switch {
+	case local != nil && remote != nil:
+		if !isModified(*local, *remote) {
+			return chooseLocal
+		}
+		if base != nil {
+			if !isModified(*local, *base) {
+				return chooseRemote
+			}
+			if !isModified(*remote, *base) {
+				return chooseLocal
+			}
+		}
+		return chooseConflict
+	case local != nil:
+		// deleted in remote base and not modified in local since the last sync
+		if base != nil && !isModified(*local, *base) {
+			return chooseNone
+		}
+		return chooseLocal
+	case remote != nil:
+		if base != nil && !isModified(*remote, *base) {
+			return chooseNone
+		}
+		return chooseRemote
+	}
+
+	return chooseNone
+}
+
+// treeMerger does a three-way merge of two group trees matching groups and entries by uuid,
+// base is the tree from the last synced state and tells additions, deletions and modifications apart
+type treeMerger struct {
+	base   *treeIndex
+	local  *treeIndex
+	remote *treeIndex
+	// groups and entries with a tombstone newer than their last modification are dropped
+	deletedObjects []gokeepasslib.DeletedObjectData
+	// history limits of the merge result
+	meta *gokeepasslib.MetaData
+	// sizes of attachments in the binary pool, counted in the history size
+	binarySizes map[int]int64
+	// resolves entries modified on both sides
+	resolver ConflictResolver
+	// name of the device running the merge, used in titles of conflicting versions
+	device string
+
+	merged *treeIndex
+	// deleted groups are kept around in case some of their children survive the merge
+	deletedGroups map[gokeepasslib.UUID]groupRecord
+	// versions which couldn't be merged safely
+	conflicts []gokeepasslib.Entry
+	// uuids of the copies of conflicting versions stored in the conflicts group
+	conflictCopies []gokeepasslib.UUID
+}
+
+func (merger *treeMerger) merge() *treeIndex {
+	if merger.base == nil {
+		merger.base = newEmptyTreeIndex(merger.local.rootUUID)
+	}
+	merger.base.aliasRoot(merger.local.rootUUID)
+	merger.remote.aliasRoot(merger.local.rootUUID)
+	merger.merged = newEmptyTreeIndex(merger.local.rootUUID)
+	merger.deletedGroups = make(map[gokeepasslib.UUID]groupRecord)
+
+	merger.mergeGroups()
+	merger.mergeEntries()
+	merger.applyDeletedObjects()
+	merger.storeConflicts()
+	merger.merged.restoreParents(merger.deletedGroups)
+
+	return merger.merged
+}
+
+func (merger *treeMerger) mergeGroups() {
+	for _, id := range unionUUIDs(merger.local.groupOrder, merger.remote.groupOrder) {
+		var baseTimes, localTimes, remoteTimes *gokeepasslib.TimeData
+		var basePlacement, localPlacement, remotePlacement *placement
+		baseRecord, inBase := merger.base.groups[id]
+		if inBase {
+			baseTimes = &baseRecord.group.Times
+			basePlacement = &placement{parent: baseRecord.parent, times: baseTimes}
+		}
+		localRecord, inLocal := merger.local.groups[id]
+		if inLocal {
+			localTimes = &localRecord.group.Times
+			localPlacement = &placement{parent: localRecord.parent, times: localTimes}
+		}
+		remoteRecord, inRemote := merger.remote.groups[id]
+		if inRemote {
+			remoteTimes = &remoteRecord.group.Times
+			remotePlacement = &placement{parent: remoteRecord.parent, times: remoteTimes}
+		}
+
+		var record groupRecord
+		switch chooseVersion(baseTimes, localTimes, remoteTimes) {
+		case chooseLocal:
+			record = localRecord
+		case chooseRemote:
+			record = remoteRecord
+		case chooseConflict:
+			// group properties are not worth a conflict, the latest modified version wins
+			record = localRecord
+			if isNewer(remoteRecord.group.Times, localRecord.group.Times) {
+				record = remoteRecord
+			}
+		case chooseNone:
+			if inLocal {
+				merger.deletedGroups[id] = localRecord
+			} else {
+				merger.deletedGroups[id] = remoteRecord
+			}
+			continue
+		}
+
+		chosenPlacement := choosePlacement(basePlacement, localPlacement, remotePlacement)
+		record.parent = chosenPlacement.parent
+		record.group.Times.LocationChanged = copyTime(chosenPlacement.times.LocationChanged)
+		merger.merged.putGroup(id, record)
+	}
+}
+
+func (merger *treeMerger) mergeEntries() {
+	for _, id := range unionUUIDs(merger.local.entryOrder, merger.remote.entryOrder) {
+		var baseTimes, localTimes, remoteTimes *gokeepasslib.TimeData
+		var basePlacement, localPlacement, remotePlacement *placement
+		baseRecord, inBase := merger.base.entries[id]
+		if inBase {
+			baseTimes = &baseRecord.entry.Times
+			basePlacement = &placement{parent: baseRecord.parent, times: baseTimes}
+		}
+		localRecord, inLocal := merger.local.entries[id]
+		if inLocal {
+			localTimes = &localRecord.entry.Times
+			localPlacement = &placement{parent: localRecord.parent, times: localTimes}
+		}
+		remoteRecord, inRemote := merger.remote.entries[id]
+		if inRemote {
+			remoteTimes = &remoteRecord.entry.Times
+			remotePlacement = &placement{parent: remoteRecord.parent, times: remoteTimes}
+		}
+
+		var record entryRecord
+		switch chooseVersion(baseTimes, localTimes, remoteTimes) {
+		case chooseLocal:
+			record = localRecord
+			if inRemote {
+				record.entry = mergeHistories(localRecord.entry, remoteRecord.entry, merger.meta, merger.binarySizes)
+			}
+		case chooseRemote:
+			record = remoteRecord
+			if inLocal {
+				record.entry = mergeHistories(remoteRecord.entry, localRecord.entry, merger.meta, merger.binarySizes)
+			}
+		case chooseConflict:
+			conflict := EntryConflict{Local: localRecord.entry, Remote: remoteRecord.entry}
+			if inBase {
+				conflict.Base = &baseRecord.entry
+			}
+			merger.resolveConflict(conflict, choosePlacement(basePlacement, localPlacement, remotePlacement))
+			continue
+		case chooseNone:
+			continue
+		}
+
+		chosenPlacement := choosePlacement(basePlacement, localPlacement, remotePlacement)
+		record.parent = chosenPlacement.parent
+		record.entry.Times.LocationChanged = copyTime(chosenPlacement.times.LocationChanged)
+		merger.merged.putEntry(id, record)
+	}
+}
+
+func (merger *treeMerger) resolveConflict(conflict EntryConflict, chosenPlacement placement) {
+	resolver := merger.resolver
+	if resolver == nil {
+		resolver = ConflictResolverFunc(newestWins)
+	}
+	resolution := resolver.Resolve(conflict)
+
+	entry := mergeHistories(resolution.Entry, conflict.Local, merger.meta, merger.binarySizes)
+	entry = mergeHistories(entry, conflict.Remote, merger.meta, merger.binarySizes)
+	entry.Times.LocationChanged = copyTime(chosenPlacement.times.LocationChanged)
+	merger.merged.putEntry(entry.UUID, entryRecord{entry: entry, parent: chosenPlacement.parent})
+	for _, duplicate := range resolution.Duplicates {
+		merger.merged.putEntry(duplicate.UUID, entryRecord{entry: duplicate, parent: chosenPlacement.parent})
+	}
+	merger.conflicts = append(merger.conflicts, resolution.Conflicts...)
+}
+
+// placement is the location of a group or an entry on one side of the merge
+type placement struct {
+	parent gokeepasslib.UUID
+	times  *gokeepasslib.TimeData
+}
+
+// choosePlacement decides the parent group of an object kept by the merge, nil means the object is missing
+// on that side, the side which moved the object since the last sync wins and when it was moved on both sides
+// the latest LocationChanged wins
+func choosePlacement(base *placement, local *placement, remote *placement) placement {
+	switch {
+	case remote == nil:
+		return *local
+	case local == nil:
+		return *remote
+	case local.parent != remote.parent && base != nil && local.parent == base.parent:
+		return *remote
+	case local.parent != remote.parent && base != nil && remote.parent == base.parent:
+		return *local
+	case timeOf(remote.times.LocationChanged).After(timeOf(local.times.LocationChanged)):
+		return *remote
+	}
+
+	return *local
+}
+
+// storeConflicts puts conflicting versions as new entries into the conflicts group
+func (merger *treeMerger) storeConflicts() {
+	if len(merger.conflicts) == 0 {
+		return
+	}
+	groupUUID := merger.conflictsGroup()
+	now := time.Now()
+
+	for _, conflict := range merger.conflicts {
+		entry := copyEntry(conflict)
+		entry.UUID = gokeepasslib.NewUUID()
+		entry.Histories = nil
+		suffix := fmt.Sprintf(" (sync conflict, %s %s)", merger.device, now.Format("2006-01-02 15:04"))
+		if title := entry.Get("Title"); title != nil {
+			title.Value.Content += suffix
+		} else {
+			entry.Values = append(entry.Values, gokeepasslib.ValueData{
+				Key:   "Title",
+				Value: gokeepasslib.V{Content: suffix[1:]},
+			})
+		}
+		merger.merged.putEntry(entry.UUID, entryRecord{entry: entry, parent: groupUUID})
+		merger.conflictCopies = append(merger.conflictCopies, entry.UUID)
+	}
+}
+
+// conflictsGroup finds the conflicts group under the root group or creates a new one
+func (merger *treeMerger) conflictsGroup() gokeepasslib.UUID {
+	rootUUID := merger.merged.rootUUID
+	for _, id := range merger.merged.groupOrder {
+		record := merger.merged.groups[id]
+		if record.parent == rootUUID && record.group.Name == conflictsGroupName {
+			return id
+		}
+	}
+	group := gokeepasslib.NewGroup()
+	group.Name = conflictsGroupName
+	merger.merged.putGroup(group.UUID, groupRecord{group: group, parent: rootUUID})
+
+	return group.UUID
+}
+
+func (merger *treeMerger) applyDeletedObjects() {
+	for _, deletedObject := range merger.deletedObjects {
+		id := deletedObject.UUID
+		if record, ok := merger.merged.groups[id]; ok && id != merger.merged.rootUUID {
+			if deletionTime(deletedObject).After(lastModified(record.group.Times)) {
+				merger.merged.removeGroup(id)
+				merger.deletedGroups[id] = record
+			}
+		}
+		if record, ok := merger.merged.entries[id]; ok {
+			if deletionTime(deletedObject).After(lastModified(record.entry.Times)) {
+				merger.merged.removeEntry(id)
+			}
+		}
+	}
+}
+
+// mergeDeletedObjects unions tombstones of both bases keeping the latest deletion time for every uuid
+func mergeDeletedObjects(
+	local []gokeepasslib.DeletedObjectData,
+	remote []gokeepasslib.DeletedObjectData,
+) []gokeepasslib.DeletedObjectData {
+	var merged []gokeepasslib.DeletedObjectData
+	positions := make(map[gokeepasslib.UUID]int)
+
+	for _, deletedObject := range append(append([]gokeepasslib.DeletedObjectData(nil), local...), remote...) {
+		position, ok := positions[deletedObject.UUID]
+		if !ok {
+			positions[deletedObject.UUID] = len(merged)
+			merged = append(merged, deletedObject)
+		} else if deletionTime(deletedObject).After(deletionTime(merged[position])) {
+			merged[position] = deletedObject
+		}
+	}
+
+	return merged
+}
+
+func deletionTime(deletedObject gokeepasslib.DeletedObjectData) time.Time {
+	return timeOf(deletedObject.DeletionTime)
+}
+
+// restoreParents brings back deleted groups which still have surviving children,
+// e.g. a group deleted on one side while an entry was added to it on the other side
+func (index *treeIndex) restoreParents(deletedGroups map[gokeepasslib.UUID]groupRecord) {
+	var restore func(parent gokeepasslib.UUID)
+	restore = func(parent gokeepasslib.UUID) {
+		record, ok := deletedGroups[parent]
+		if !ok {
+			return
+		}
+		delete(deletedGroups, parent)
+		index.putGroup(parent, record)
+		restore(record.parent)
+	}
+
+	for _, id := range index.groupOrder {
+		restore(index.groups[id].parent)
+	}
+	for _, id := range index.entryOrder {
+		restore(index.entries[id].parent)
+	}
+}
+
+// unionUUIDs keeps the order of the first list and appends missing uuids from the second one
+func unionUUIDs(first []gokeepasslib.UUID, second []gokeepasslib.UUID) []gokeepasslib.UUID {
+	seen := make(map[gokeepasslib.UUID]bool, len(first))
+	union := make([]gokeepasslib.UUID, 0, len(first)+len(second))
+	for _, id := range first {
+		seen[id] = true
+		union = append(union, id)
+	}
+	for _, id := range second {
+		if !seen[id] {
+			seen[id] = true
+			union = append(union, id)
+		}
+	}
+
+	return union
+}
+
+func removeUUID(ids []gokeepasslib.UUID, id gokeepasslib.UUID) []gokeepasslib.UUID {
+	for i := range ids {
+		if ids[i] == id {
+			return append(ids[:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
+
+func lastModified(times gokeepasslib.TimeData) time.Time {
+	return timeOf(times.LastModificationTime)
+}
+
+// isModified reports whether the object was modified since the given version
+func isModified(times gokeepasslib.TimeData, since gokeepasslib.TimeData) bool {
+	return !lastModified(times).Equal(lastModified(since))
+}
+
+// isNewer reports whether the first object was modified after the second one
+func isNewer(first gokeepasslib.TimeData, second gokeepasslib.TimeData) bool {
+	return lastModified(first).After(lastModified(second))
+}
+
+// copyEntry makes a deep copy of an entry keeping its uuid
+func copyEntry(entry gokeepasslib.Entry) gokeepasslib.Entry {
+	entryCopy := entry
+	entryCopy.Values = append([]gokeepasslib.ValueData(nil), entry.Values...)
+	entryCopy.Binaries = append([]gokeepasslib.BinaryReference(nil), entry.Binaries...)
+	entryCopy.CustomData = append([]gokeepasslib.CustomData(nil), entry.CustomData...)
+	entryCopy.AutoType.Associations = append([]gokeepasslib.AutoTypeAssociation(nil), entry.AutoType.Associations...)
+	entryCopy.Histories = make([]gokeepasslib.History, len(entry.Histories))
+	for i, history := range entry.Histories {
+		entryCopy.Histories[i].Entries = make([]gokeepasslib.Entry, len(history.Entries))
+		for j, historyEntry := range history.Entries {
+			entryCopy.Histories[i].Entries[j] = copyEntry(historyEntry)
+		}
+	}
+
+	return entryCopy
+}
@@ -0,0 +1,487 @@
+package keepass_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"kdbxsync/keepass"
+	"kdbxsync/settings"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+var baseTime = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func mkTimes(modified time.Time) gokeepasslib.TimeData {
+	times := gokeepasslib.NewTimeData()
+	lastModified := w.Now()
+	lastModified.Time = modified
+	times.LastModificationTime = &lastModified
+	return times
+}
+
+func mkEntry(id gokeepasslib.UUID, title string, password string, modified time.Time) gokeepasslib.Entry {
+	entry := gokeepasslib.NewEntry()
+	entry.UUID = id
+	entry.Times = mkTimes(modified)
+	entry.Values = append(entry.Values, mkValue("Title", title))
+	entry.Values = append(entry.Values, mkProtectedValue("Password", password))
+	return entry
+}
+
+func mkGroup(id gokeepasslib.UUID, name string, modified time.Time) gokeepasslib.Group {
+	group := gokeepasslib.NewGroup()
+	group.UUID = id
+	group.Name = name
+	group.Times = mkTimes(modified)
+	return group
+}
+
+func newTestDatabase(root gokeepasslib.Group) *gokeepasslib.Database {
+	return &gokeepasslib.Database{
+		Header:      gokeepasslib.NewHeader(),
+		Credentials: gokeepasslib.NewPasswordCredentials("pass"),
+		Content: &gokeepasslib.DBContent{
+			Meta: gokeepasslib.NewMetaData(),
+			Root: &gokeepasslib.RootData{
+				Groups: []gokeepasslib.Group{root},
+			},
+		},
+	}
+}
+
+func encodeTestDatabase(t *testing.T, db *gokeepasslib.Database) []byte {
+	buffer := &bytes.Buffer{}
+	require.NoError(t, db.LockProtectedEntries())
+	require.NoError(t, gokeepasslib.NewEncoder(buffer).Encode(db))
+	require.NoError(t, db.UnlockProtectedEntries())
+	return buffer.Bytes()
+}
+
+func newTestSettings(t *testing.T) *settings.AppSettings {
+	dbSettings := settings.DataBaseSettings{
+		Directory:       t.TempDir(),
+		FileName:        "testfile.kdbx",
+		Password:        "pass",
+		BackupDirectory: "backups",
+	}
+	return &settings.AppSettings{
+		HTTPServer:         &FakeHTTPServer{},
+		DatabaseSettings:   &dbSettings,
+		StorageCredentials: "pass",
+	}
+}
+
+// mergeTestDatabases runs the merge of two bases and returns the decoded sync DB,
+// base is the last synced state and can be nil
+func mergeTestDatabases(
+	t *testing.T,
+	base *gokeepasslib.Database,
+	local *gokeepasslib.Database,
+	remote *gokeepasslib.Database,
+	options ...func(dbSync *keepass.DBSync),
+) *gokeepasslib.Database {
+	appSettings := newTestSettings(t)
+	localData := encodeTestDatabase(t, local)
+	remoteData := encodeTestDatabase(t, remote)
+
+	dbSync, err := keepass.NewKeepassDBSync(
+		bytes.NewReader(localData),
+		bytes.NewReader(remoteData),
+		&fakeStorage{},
+		appSettings,
+	)
+	require.NoError(t, err)
+	if base != nil {
+		require.NoError(t, dbSync.LoadBase(bytes.NewReader(encodeTestDatabase(t, base))))
+	}
+	for _, option := range options {
+		option(dbSync)
+	}
+	data, err := dbSync.Merged()
+	require.NoError(t, err)
+
+	syncDB := gokeepasslib.NewDatabase()
+	syncDB.Credentials = gokeepasslib.NewPasswordCredentials("pass")
+	require.NoError(t, gokeepasslib.NewDecoder(bytes.NewReader(data)).Decode(syncDB))
+	require.NoError(t, syncDB.UnlockProtectedEntries())
+
+	return syncDB
+}
+
+func findGroup(groups []gokeepasslib.Group, name string) *gokeepasslib.Group {
+	for i := range groups {
+		if groups[i].Name == name {
+			return &groups[i]
+		}
+		if group := findGroup(groups[i].Groups, name); group != nil {
+			return group
+		}
+	}
+	return nil
+}
+
+func countEntries(groups []gokeepasslib.Group) int {
+	count := 0
+	for _, group := range groups {
+		count += len(group.Entries) + countEntries(group.Groups)
+	}
+	return count
+}
+
+func TestSyncBases(t *testing.T) {
+	rootID := gokeepasslib.NewUUID()
+	emailID := gokeepasslib.NewUUID()
+	workID := gokeepasslib.NewUUID()
+	bankingID := gokeepasslib.NewUUID()
+	mailEntryID := gokeepasslib.NewUUID()
+	workEntryID := gokeepasslib.NewUUID()
+	bankEntryID := gokeepasslib.NewUUID()
+
+	t.Run("success: merge nested groups", func(t *testing.T) {
+		localRoot := mkGroup(rootID, "Root", baseTime)
+		localEmail := mkGroup(emailID, "Email", baseTime)
+		localEmail.Entries = append(localEmail.Entries, mkEntry(mailEntryID, "Mail", "old", baseTime))
+		localWork := mkGroup(workID, "Work", baseTime)
+		localWork.Entries = append(localWork.Entries, mkEntry(workEntryID, "Work mail", "work", baseTime))
+		localEmail.Groups = append(localEmail.Groups, localWork)
+		localRoot.Groups = append(localRoot.Groups, localEmail)
+
+		remoteRoot := mkGroup(rootID, "Root", baseTime)
+		remoteEmail := mkGroup(emailID, "Email", baseTime)
+		remoteEmail.Entries = append(remoteEmail.Entries, mkEntry(mailEntryID, "Mail", "new", baseTime.Add(time.Hour)))
+		remoteBanking := mkGroup(bankingID, "Banking", baseTime)
+		remoteBanking.Entries = append(remoteBanking.Entries, mkEntry(bankEntryID, "Bank", "bank", baseTime))
+		remoteRoot.Groups = append(remoteRoot.Groups, remoteEmail, remoteBanking)
+
+		syncDB := mergeTestDatabases(t, nil, newTestDatabase(localRoot), newTestDatabase(remoteRoot))
+		groups := syncDB.Content.Root.Groups
+
+		assert.Len(t, groups, 1)
+		assert.Equal(t, 3, countEntries(groups))
+
+		email := findGroup(groups, "Email")
+		work := findGroup(groups, "Work")
+		banking := findGroup(groups, "Banking")
+		require.NotNil(t, email)
+		require.NotNil(t, work)
+		require.NotNil(t, banking)
+		assert.Len(t, email.Groups, 1)
+		assert.Equal(t, "new", email.Entries[0].GetPassword())
+		assert.Equal(t, "work", work.Entries[0].GetPassword())
+		assert.Equal(t, "bank", banking.Entries[0].GetPassword())
+	})
+
+	t.Run("success: root groups with different uuids are matched", func(t *testing.T) {
+		localRoot := mkGroup(rootID, "Root", baseTime)
+		localRoot.Entries = append(localRoot.Entries, mkEntry(mailEntryID, "Mail", "mail", baseTime))
+
+		remoteRoot := mkGroup(gokeepasslib.NewUUID(), "Root", baseTime)
+		remoteRoot.Entries = append(remoteRoot.Entries, mkEntry(bankEntryID, "Bank", "bank", baseTime))
+
+		syncDB := mergeTestDatabases(t, nil, newTestDatabase(localRoot), newTestDatabase(remoteRoot))
+		groups := syncDB.Content.Root.Groups
+
+		assert.Len(t, groups, 1)
+		assert.Equal(t, rootID, groups[0].UUID)
+		assert.Len(t, groups[0].Entries, 2)
+	})
+}
+
+func TestSyncBasesThreeWay(t *testing.T) {
+	rootID := gokeepasslib.NewUUID()
+	groupID := gokeepasslib.NewUUID()
+	keptID := gokeepasslib.NewUUID()
+	deletedID := gokeepasslib.NewUUID()
+	modifiedID := gokeepasslib.NewUUID()
+	addedID := gokeepasslib.NewUUID()
+
+	newBase := func() *gokeepasslib.Database {
+		root := mkGroup(rootID, "Root", baseTime)
+		root.Entries = append(
+			root.Entries,
+			mkEntry(keptID, "Kept", "kept", baseTime),
+			mkEntry(deletedID, "Deleted", "deleted", baseTime),
+			mkEntry(modifiedID, "Modified", "modified", baseTime),
+		)
+		group := mkGroup(groupID, "Group", baseTime)
+		root.Groups = append(root.Groups, group)
+		return newTestDatabase(root)
+	}
+
+	t.Run("success: deletions propagate", func(t *testing.T) {
+		local := newBase()
+		// deleted entry and group locally
+		local.Content.Root.Groups[0].Entries = local.Content.Root.Groups[0].Entries[:1]
+		local.Content.Root.Groups[0].Groups = nil
+		remote := newBase()
+		remote.Content.Root.Groups[0].Entries[2].Values[1].Value.Content = "changed"
+		remote.Content.Root.Groups[0].Entries[2].Times = mkTimes(baseTime.Add(time.Hour))
+		remote.Content.Root.Groups[0].Entries = append(
+			remote.Content.Root.Groups[0].Entries,
+			mkEntry(addedID, "Added", "added", baseTime),
+		)
+
+		syncDB := mergeTestDatabases(t, newBase(), local, remote)
+		root := syncDB.Content.Root.Groups[0]
+
+		titles := []string{}
+		for _, entry := range root.Entries {
+			titles = append(titles, entry.GetTitle())
+		}
+		// modified on remote wins over deleted on local
+		assert.ElementsMatch(t, []string{"Kept", "Modified", "Added"}, titles)
+		assert.Empty(t, root.Groups)
+	})
+
+	t.Run("success: deleted group with new entry is kept", func(t *testing.T) {
+		local := newBase()
+		local.Content.Root.Groups[0].Groups = nil
+		remote := newBase()
+		remote.Content.Root.Groups[0].Groups[0].Entries = append(
+			remote.Content.Root.Groups[0].Groups[0].Entries,
+			mkEntry(addedID, "Added", "added", baseTime),
+		)
+
+		syncDB := mergeTestDatabases(t, newBase(), local, remote)
+		group := findGroup(syncDB.Content.Root.Groups, "Group")
+
+		require.NotNil(t, group)
+		assert.Len(t, group.Entries, 1)
+	})
+
+	t.Run("success: without base entries are never deleted", func(t *testing.T) {
+		local := newBase()
+		local.Content.Root.Groups[0].Entries = local.Content.Root.Groups[0].Entries[:1]
+		remote := newBase()
+
+		syncDB := mergeTestDatabases(t, nil, local, remote)
+
+		assert.Len(t, syncDB.Content.Root.Groups[0].Entries, 3)
+	})
+}
+
+func TestSyncBasesMoves(t *testing.T) {
+	rootID := gokeepasslib.NewUUID()
+	emailID := gokeepasslib.NewUUID()
+	workID := gokeepasslib.NewUUID()
+	entryID := gokeepasslib.NewUUID()
+
+	moved := func(times *gokeepasslib.TimeData, at time.Time) {
+		locationChanged := w.Now()
+		locationChanged.Time = at
+		times.LocationChanged = &locationChanged
+	}
+	newBase := func() *gokeepasslib.Database {
+		root := mkGroup(rootID, "Root", baseTime)
+		root.Entries = append(root.Entries, mkEntry(entryID, "Entry", "entry", baseTime))
+		root.Groups = append(root.Groups, mkGroup(emailID, "Email", baseTime), mkGroup(workID, "Work", baseTime))
+		return newTestDatabase(root)
+	}
+
+	t.Run("success: entry moved on one side", func(t *testing.T) {
+		remote := newBase()
+		root := &remote.Content.Root.Groups[0]
+		entry := root.Entries[0]
+		moved(&entry.Times, baseTime.Add(time.Hour))
+		root.Entries = nil
+		root.Groups[0].Entries = append(root.Groups[0].Entries, entry)
+
+		syncDB := mergeTestDatabases(t, newBase(), newBase(), remote)
+
+		assert.Empty(t, syncDB.Content.Root.Groups[0].Entries)
+		email := findGroup(syncDB.Content.Root.Groups, "Email")
+		require.NotNil(t, email)
+		require.Len(t, email.Entries, 1)
+		assert.Equal(t, entryID, email.Entries[0].UUID)
+		assert.Equal(t, 1, countEntries(syncDB.Content.Root.Groups))
+	})
+
+	t.Run("success: group moved and renamed on one side", func(t *testing.T) {
+		local := newBase()
+		root := &local.Content.Root.Groups[0]
+		work := root.Groups[1]
+		work.Name = "Job"
+		work.Times = mkTimes(baseTime.Add(time.Hour))
+		moved(&work.Times, baseTime.Add(time.Hour))
+		root.Groups = root.Groups[:1]
+		root.Groups[0].Groups = append(root.Groups[0].Groups, work)
+
+		syncDB := mergeTestDatabases(t, newBase(), local, newBase())
+
+		assert.Nil(t, findGroup(syncDB.Content.Root.Groups, "Work"))
+		email := findGroup(syncDB.Content.Root.Groups, "Email")
+		require.NotNil(t, email)
+		require.Len(t, email.Groups, 1)
+		assert.Equal(t, "Job", email.Groups[0].Name)
+		assert.Len(t, syncDB.Content.Root.Groups[0].Groups, 1)
+	})
+
+	t.Run("success: latest move wins when moved on both sides", func(t *testing.T) {
+		local := newBase()
+		localRoot := &local.Content.Root.Groups[0]
+		localEntry := localRoot.Entries[0]
+		moved(&localEntry.Times, baseTime.Add(time.Hour))
+		localRoot.Entries = nil
+		localRoot.Groups[0].Entries = append(localRoot.Groups[0].Entries, localEntry)
+		remote := newBase()
+		remoteRoot := &remote.Content.Root.Groups[0]
+		remoteEntry := remoteRoot.Entries[0]
+		moved(&remoteEntry.Times, baseTime.Add(2*time.Hour))
+		remoteRoot.Entries = nil
+		remoteRoot.Groups[1].Entries = append(remoteRoot.Groups[1].Entries, remoteEntry)
+
+		syncDB := mergeTestDatabases(t, newBase(), local, remote)
+
+		work := findGroup(syncDB.Content.Root.Groups, "Work")
+		require.NotNil(t, work)
+		require.Len(t, work.Entries, 1)
+		assert.True(t, work.Entries[0].Times.LocationChanged.Time.Equal(baseTime.Add(2*time.Hour)))
+		assert.Equal(t, 1, countEntries(syncDB.Content.Root.Groups))
+	})
+}
+
+func TestSyncBasesReplicas(t *testing.T) {
+	rootID := gokeepasslib.NewUUID()
+	sharedID := gokeepasslib.NewUUID()
+	deletedID := gokeepasslib.NewUUID()
+
+	newBase := func() *gokeepasslib.Database {
+		root := mkGroup(rootID, "Root", baseTime)
+		root.Entries = append(
+			root.Entries,
+			mkEntry(sharedID, "Shared", "shared", baseTime),
+			mkEntry(deletedID, "Deleted", "deleted", baseTime),
+		)
+		return newTestDatabase(root)
+	}
+	withEntry := func(entry gokeepasslib.Entry) *gokeepasslib.Database {
+		db := newBase()
+		db.Content.Root.Groups[0].Entries = append(db.Content.Root.Groups[0].Entries, entry)
+		return db
+	}
+	addReplica := func(t *testing.T, name string, db *gokeepasslib.Database) func(dbSync *keepass.DBSync) {
+		data := encodeTestDatabase(t, db)
+		return func(dbSync *keepass.DBSync) {
+			require.NoError(t, dbSync.AddReplica(name, bytes.NewReader(data), &fakeStorage{}))
+		}
+	}
+	titles := func(db *gokeepasslib.Database) []string {
+		var titles []string
+		for _, entry := range db.Content.Root.Groups[0].Entries {
+			titles = append(titles, entry.GetTitle())
+		}
+		return titles
+	}
+
+	t.Run("success: changes of all replicas are merged", func(t *testing.T) {
+		nas := newBase()
+		nas.Content.Root.Groups[0].Entries = nas.Content.Root.Groups[0].Entries[:1]
+		usb := newBase()
+		usb.Content.Root.Groups[0].Entries[0].Values[1].Value.Content = "changed"
+		usb.Content.Root.Groups[0].Entries[0].Times = mkTimes(baseTime.Add(time.Hour))
+
+		syncDB := mergeTestDatabases(
+			t,
+			newBase(),
+			withEntry(mkEntry(gokeepasslib.NewUUID(), "Local", "local", baseTime)),
+			withEntry(mkEntry(gokeepasslib.NewUUID(), "Remote", "remote", baseTime)),
+			addReplica(t, "nas", nas),
+			addReplica(t, "usb", usb),
+		)
+
+		assert.ElementsMatch(t, []string{"Shared", "Local", "Remote"}, titles(syncDB))
+		for _, entry := range syncDB.Content.Root.Groups[0].Entries {
+			if entry.UUID == sharedID {
+				assert.Equal(t, "changed", entry.GetPassword())
+			}
+		}
+	})
+
+	t.Run("success: result doesn't depend on replica order", func(t *testing.T) {
+		first := newBase()
+		first.Content.Root.Groups[0].Entries[0].Values[1].Value.Content = "first"
+		first.Content.Root.Groups[0].Entries[0].Times = mkTimes(baseTime.Add(time.Hour))
+		second := newBase()
+		second.Content.Root.Groups[0].Entries[0].Values[1].Value.Content = "second"
+		second.Content.Root.Groups[0].Entries[0].Times = mkTimes(baseTime.Add(2 * time.Hour))
+
+		passwords := func(syncDB *gokeepasslib.Database) []string {
+			var passwords []string
+			for _, entry := range syncDB.Content.Root.Groups[0].Entries {
+				passwords = append(passwords, entry.GetPassword())
+			}
+			return passwords
+		}
+		syncDB1 := mergeTestDatabases(
+			t, newBase(), newBase(), newBase(), addReplica(t, "a", first), addReplica(t, "b", second),
+		)
+		syncDB2 := mergeTestDatabases(
+			t, newBase(), newBase(), newBase(), addReplica(t, "b", second), addReplica(t, "a", first),
+		)
+
+		assert.Equal(t, passwords(syncDB1), passwords(syncDB2))
+		assert.Contains(t, passwords(syncDB1), "second")
+	})
+
+	t.Run("error: duplicated replica name", func(t *testing.T) {
+		data := encodeTestDatabase(t, newBase())
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(data),
+			bytes.NewReader(data),
+			&fakeStorage{},
+			newTestSettings(t),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, dbSync.AddReplica("nas", bytes.NewReader(data), &fakeStorage{}))
+		err = dbSync.AddReplica("nas", bytes.NewReader(data), &fakeStorage{})
+
+		assert.EqualError(t, err, "replica nas is already added")
+	})
+}
+
+func TestSyncBasesDeletedObjects(t *testing.T) {
+	rootID := gokeepasslib.NewUUID()
+	deletedID := gokeepasslib.NewUUID()
+	restoredID := gokeepasslib.NewUUID()
+
+	mkDeletedObject := func(id gokeepasslib.UUID, deleted time.Time) gokeepasslib.DeletedObjectData {
+		deletionTime := w.Now()
+		deletionTime.Time = deleted
+		return gokeepasslib.DeletedObjectData{UUID: id, DeletionTime: &deletionTime}
+	}
+
+	t.Run("success: tombstones drop older entries", func(t *testing.T) {
+		local := newTestDatabase(mkGroup(rootID, "Root", baseTime))
+		local.Content.Root.DeletedObjects = append(
+			local.Content.Root.DeletedObjects,
+			mkDeletedObject(deletedID, baseTime.Add(time.Hour)),
+			mkDeletedObject(restoredID, baseTime.Add(time.Hour)),
+		)
+		remoteRoot := mkGroup(rootID, "Root", baseTime)
+		remoteRoot.Entries = append(
+			remoteRoot.Entries,
+			mkEntry(deletedID, "Deleted", "deleted", baseTime),
+			mkEntry(restoredID, "Restored", "restored", baseTime.Add(2*time.Hour)),
+		)
+		remote := newTestDatabase(remoteRoot)
+		remote.Content.Root.DeletedObjects = append(
+			remote.Content.Root.DeletedObjects,
+			mkDeletedObject(deletedID, baseTime.Add(30*time.Minute)),
+		)
+
+		syncDB := mergeTestDatabases(t, nil, local, remote)
+		root := syncDB.Content.Root.Groups[0]
+
+		require.Len(t, root.Entries, 1)
+		assert.Equal(t, "Restored", root.Entries[0].GetTitle())
+		require.Len(t, syncDB.Content.Root.DeletedObjects, 2)
+		assert.Equal(t, deletedID, syncDB.Content.Root.DeletedObjects[0].UUID)
+		assert.True(t, syncDB.Content.Root.DeletedObjects[0].DeletionTime.Time.Equal(baseTime.Add(time.Hour)))
+	})
+}
@@ -0,0 +1,88 @@
+package keepass
+
+import (
+	"time"
+
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+// mergeMeta merges database level settings of the remote base into the meta of the sync DB
+// which starts as a copy of the local one, fields with their own "changed" time are merged by it
+// and the rest of settings are taken from the base with the latest SettingsChanged
+func mergeMeta(merged *gokeepasslib.MetaData, remote *gokeepasslib.MetaData) {
+	if isNewerTime(remote.DatabaseNameChanged, merged.DatabaseNameChanged) {
+		merged.DatabaseName = remote.DatabaseName
+		merged.DatabaseNameChanged = copyTime(remote.DatabaseNameChanged)
+	}
+	if isNewerTime(remote.DatabaseDescriptionChanged, merged.DatabaseDescriptionChanged) {
+		merged.DatabaseDescription = remote.DatabaseDescription
+		merged.DatabaseDescriptionChanged = copyTime(remote.DatabaseDescriptionChanged)
+	}
+	if isNewerTime(remote.DefaultUserNameChanged, merged.DefaultUserNameChanged) {
+		merged.DefaultUserName = remote.DefaultUserName
+		merged.DefaultUserNameChanged = copyTime(remote.DefaultUserNameChanged)
+	}
+	if isNewerTime(remote.RecycleBinChanged, merged.RecycleBinChanged) {
+		merged.RecycleBinEnabled = remote.RecycleBinEnabled
+		merged.RecycleBinUUID = remote.RecycleBinUUID
+		merged.RecycleBinChanged = copyTime(remote.RecycleBinChanged)
+	}
+	if isNewerTime(remote.EntryTemplatesGroupChanged, merged.EntryTemplatesGroupChanged) {
+		merged.EntryTemplatesGroup = remote.EntryTemplatesGroup
+		merged.EntryTemplatesGroupChanged = copyTime(remote.EntryTemplatesGroupChanged)
+	}
+
+	remoteSettingsNewer := isNewerTime(remote.SettingsChanged, merged.SettingsChanged)
+	merged.CustomData = mergeMetaCustomData(merged.CustomData, remote.CustomData, remoteSettingsNewer)
+	if !remoteSettingsNewer {
+		return
+	}
+	merged.Color = remote.Color
+	merged.HistoryMaxItems = remote.HistoryMaxItems
+	merged.HistoryMaxSize = remote.HistoryMaxSize
+	merged.MaintenanceHistoryDays = remote.MaintenanceHistoryDays
+	merged.MemoryProtection = remote.MemoryProtection
+	merged.MasterKeyChangeRec = remote.MasterKeyChangeRec
+	merged.MasterKeyChangeForce = remote.MasterKeyChangeForce
+	merged.SettingsChanged = copyTime(remote.SettingsChanged)
+}
+
+// mergeMetaCustomData unions plugin data of both bases, the base with newer settings wins on the same key
+func mergeMetaCustomData(local []gokeepasslib.CustomData, remote []gokeepasslib.CustomData, preferRemote bool) []gokeepasslib.CustomData {
+	merged := append([]gokeepasslib.CustomData(nil), local...)
+	positions := make(map[string]int)
+	for i, data := range merged {
+		positions[data.Key] = i
+	}
+	for _, data := range remote {
+		position, ok := positions[data.Key]
+		if !ok {
+			positions[data.Key] = len(merged)
+			merged = append(merged, data)
+		} else if preferRemote {
+			merged[position] = data
+		}
+	}
+
+	return merged
+}
+
+func timeOf(timeWrapper *w.TimeWrapper) time.Time {
+	if timeWrapper == nil {
+		return time.Time{}
+	}
+	return timeWrapper.Time
+}
+
+func isNewerTime(first *w.TimeWrapper, second *w.TimeWrapper) bool {
+	return timeOf(first).After(timeOf(second))
+}
+
+func copyTime(timeWrapper *w.TimeWrapper) *w.TimeWrapper {
+	if timeWrapper == nil {
+		return nil
+	}
+	timeCopy := *timeWrapper
+	return &timeCopy
+}
@@ -0,0 +1,50 @@
+package keepass_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+func TestSyncBasesMeta(t *testing.T) {
+	rootID := gokeepasslib.NewUUID()
+	recycleBinID := gokeepasslib.NewUUID()
+
+	mkTime := func(value time.Time) *w.TimeWrapper {
+		timeWrapper := w.Now()
+		timeWrapper.Time = value
+		return &timeWrapper
+	}
+
+	t.Run("success: meta fields are merged by their changed times", func(t *testing.T) {
+		local := newTestDatabase(mkGroup(rootID, "Root", baseTime))
+		local.Content.Meta.DatabaseName = "Local name"
+		local.Content.Meta.DatabaseNameChanged = mkTime(baseTime)
+		local.Content.Meta.RecycleBinChanged = mkTime(baseTime)
+		local.Content.Meta.HistoryMaxItems = 5
+		local.Content.Meta.SettingsChanged = mkTime(baseTime.Add(time.Hour))
+		local.Content.Meta.CustomData = []gokeepasslib.CustomData{{Key: "local", Value: "1"}}
+
+		remote := newTestDatabase(mkGroup(rootID, "Root", baseTime))
+		remote.Content.Meta.DatabaseName = "Remote name"
+		remote.Content.Meta.DatabaseNameChanged = mkTime(baseTime.Add(time.Hour))
+		remote.Content.Meta.RecycleBinEnabled = w.NewBoolWrapper(true)
+		remote.Content.Meta.RecycleBinUUID = recycleBinID
+		remote.Content.Meta.RecycleBinChanged = mkTime(baseTime.Add(time.Hour))
+		remote.Content.Meta.HistoryMaxItems = 20
+		remote.Content.Meta.SettingsChanged = mkTime(baseTime)
+		remote.Content.Meta.CustomData = []gokeepasslib.CustomData{{Key: "remote", Value: "2"}}
+
+		syncDB := mergeTestDatabases(t, nil, local, remote)
+		meta := syncDB.Content.Meta
+
+		assert.Equal(t, "Remote name", meta.DatabaseName)
+		assert.True(t, meta.RecycleBinEnabled.Bool)
+		assert.Equal(t, recycleBinID, meta.RecycleBinUUID)
+		assert.Equal(t, int64(5), meta.HistoryMaxItems)
+		assert.Len(t, meta.CustomData, 2)
+	})
+}
@@ -0,0 +1,127 @@
+package keepass
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+type ChangeKind string
+
+const (
+	ChangeAdded   ChangeKind = "added"
+	ChangeUpdated ChangeKind = "updated"
+	ChangeDeleted ChangeKind = "deleted"
+	// a conflicting version stored in the conflicts group
+	ChangeConflict ChangeKind = "conflict"
+)
+
+type ObjectKind string
+
+const (
+	ObjectGroup ObjectKind = "group"
+	ObjectEntry ObjectKind = "entry"
+)
+
+// Change is a group or an entry a sync would change in one of the databases
+type Change struct {
+	Kind   ChangeKind
+	Object ObjectKind
+	UUID   gokeepasslib.UUID
+	// group names from the root group down to the group or the entry title
+	Path string
+}
+
+// SideReport lists changes a sync would make to one of the databases
+type SideReport struct {
+	Side    string
+	Changes []Change
+}
+
+// SyncReport is the result of a dry run
+type SyncReport struct {
+	Sides     []SideReport
+	Conflicts int
+}
+
+// Print writes the report in a human readable form
+func (report *SyncReport) Print(out io.Writer) error {
+	for _, side := range report.Sides {
+		if len(side.Changes) == 0 {
+			_, err := fmt.Fprintf(out, "%s: already in sync\n", side.Side)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		_, err := fmt.Fprintf(out, "%s:\n", side.Side)
+		if err != nil {
+			return err
+		}
+		for _, change := range side.Changes {
+			_, err = fmt.Fprintf(out, "  %-8s %-5s %s\n", change.Kind, change.Object, change.Path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintf(out, "conflicts: %d\n", report.Conflicts)
+
+	return err
+}
+
+// DryRun merges all bases in memory and reports what Sync would change in each of them,
+// nothing is written to the local file, backups or storages
+func (keepassDBSync *DBSync) DryRun() (*SyncReport, error) {
+	err := keepassDBSync.merge()
+	if err != nil {
+		return nil, err
+	}
+
+	conflicts := make(map[gokeepasslib.UUID]bool)
+	for _, id := range keepassDBSync.conflicts {
+		conflicts[id] = true
+	}
+
+	report := &SyncReport{Conflicts: len(keepassDBSync.conflicts)}
+	for _, side := range keepassDBSync.sides() {
+		changeSet, err := Diff(side.db, keepassDBSync.syncKeepassDB)
+		if err != nil {
+			return nil, fmt.Errorf("can't compare %s base: %w", side.name, err)
+		}
+		report.Sides = append(report.Sides, SideReport{
+			Side:    side.name,
+			Changes: reportChanges(changeSet, conflicts),
+		})
+	}
+
+	return report, nil
+}
+
+// reportChanges flattens a change set of a side, new entries from the conflicts set are reported as conflicts
+func reportChanges(changeSet *ChangeSet, conflicts map[gokeepasslib.UUID]bool) []Change {
+	var changes []Change
+	addGroups := func(kind ChangeKind, groups []GroupChange) {
+		for _, group := range groups {
+			changes = append(changes, Change{Kind: kind, Object: ObjectGroup, UUID: group.UUID, Path: group.Path})
+		}
+	}
+	addEntries := func(kind ChangeKind, entries []EntryChange) {
+		for _, entry := range entries {
+			entryKind := kind
+			if kind == ChangeAdded && conflicts[entry.UUID] {
+				entryKind = ChangeConflict
+			}
+			changes = append(changes, Change{Kind: entryKind, Object: ObjectEntry, UUID: entry.UUID, Path: entry.Path})
+		}
+	}
+	addGroups(ChangeAdded, changeSet.AddedGroups)
+	addGroups(ChangeUpdated, changeSet.ModifiedGroups)
+	addEntries(ChangeAdded, changeSet.AddedEntries)
+	addEntries(ChangeUpdated, changeSet.ModifiedEntries)
+	addGroups(ChangeDeleted, changeSet.RemovedGroups)
+	addEntries(ChangeDeleted, changeSet.RemovedEntries)
+
+	return changes
+}
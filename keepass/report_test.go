@@ -0,0 +1,163 @@
+package keepass_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kdbxsync/keepass"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+func TestDryRun(t *testing.T) {
+	rootID := gokeepasslib.NewUUID()
+	groupID := gokeepasslib.NewUUID()
+	keptID := gokeepasslib.NewUUID()
+	deletedID := gokeepasslib.NewUUID()
+	modifiedID := gokeepasslib.NewUUID()
+	addedID := gokeepasslib.NewUUID()
+
+	newBase := func() *gokeepasslib.Database {
+		root := mkGroup(rootID, "Root", baseTime)
+		group := mkGroup(groupID, "Email", baseTime)
+		group.Entries = append(
+			group.Entries,
+			mkEntry(keptID, "Kept", "kept", baseTime),
+			mkEntry(deletedID, "Deleted", "deleted", baseTime),
+			mkEntry(modifiedID, "Modified", "modified", baseTime),
+		)
+		root.Groups = append(root.Groups, group)
+		return newTestDatabase(root)
+	}
+
+	t.Run("success: changes are reported for each side", func(t *testing.T) {
+		local := newBase()
+		local.Content.Root.Groups[0].Groups[0].Entries = append(
+			local.Content.Root.Groups[0].Groups[0].Entries,
+			mkEntry(addedID, "Added", "added", baseTime),
+		)
+		remote := newBase()
+		email := &remote.Content.Root.Groups[0].Groups[0]
+		email.Entries = []gokeepasslib.Entry{email.Entries[0], email.Entries[2]}
+		// edits push the previous version into the history
+		email.Entries[1].Histories = []gokeepasslib.History{{Entries: []gokeepasslib.Entry{email.Entries[1]}}}
+		email.Entries[1].Values = []gokeepasslib.ValueData{mkValue("Title", "Modified"), mkProtectedValue("Password", "changed")}
+		email.Entries[1].Times = mkTimes(baseTime.Add(time.Hour))
+
+		appSettings := newTestSettings(t)
+		localData := encodeTestDatabase(t, local)
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(localData),
+			bytes.NewReader(encodeTestDatabase(t, remote)),
+			&fakeStorage{},
+			appSettings,
+		)
+		require.NoError(t, err)
+		require.NoError(t, dbSync.LoadBase(bytes.NewReader(encodeTestDatabase(t, newBase()))))
+
+		report, err := dbSync.DryRun()
+
+		require.NoError(t, err)
+		require.Len(t, report.Sides, 2)
+		assert.Equal(t, "local", report.Sides[0].Side)
+		assert.ElementsMatch(t, []keepass.Change{
+			{Kind: keepass.ChangeUpdated, Object: keepass.ObjectEntry, UUID: modifiedID, Path: "Root/Email/Modified"},
+			{Kind: keepass.ChangeDeleted, Object: keepass.ObjectEntry, UUID: deletedID, Path: "Root/Email/Deleted"},
+		}, report.Sides[0].Changes)
+		assert.Equal(t, "remote", report.Sides[1].Side)
+		assert.Equal(t, []keepass.Change{
+			{Kind: keepass.ChangeAdded, Object: keepass.ObjectEntry, UUID: addedID, Path: "Root/Email/Added"},
+		}, report.Sides[1].Changes)
+		assert.Zero(t, report.Conflicts)
+
+		// nothing is written
+		files, err := os.ReadDir(appSettings.DatabaseSettings.Directory)
+		require.NoError(t, err)
+		assert.Empty(t, files)
+
+		output := &bytes.Buffer{}
+		require.NoError(t, report.Print(output))
+		assert.Contains(t, output.String(), "remote:\n  added    entry Root/Email/Added\n")
+	})
+
+	t.Run("success: already in sync", func(t *testing.T) {
+		data := encodeTestDatabase(t, newBase())
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(data),
+			bytes.NewReader(data),
+			&fakeStorage{},
+			newTestSettings(t),
+		)
+		require.NoError(t, err)
+
+		report, err := dbSync.DryRun()
+
+		require.NoError(t, err)
+		output := &bytes.Buffer{}
+		require.NoError(t, report.Print(output))
+		assert.Equal(t, "local: already in sync\nremote: already in sync\nconflicts: 0\n", output.String())
+	})
+}
+
+func TestInitKeepassDBDryRun(t *testing.T) {
+	t.Run("success: interrupted sync is left to the next sync", func(t *testing.T) {
+		appSettings := newTestSettings(t)
+		dbSettings := appSettings.DatabaseSettings
+		dbSettings.BackupDirectory = filepath.Join(dbSettings.Directory, "backups")
+		dbSettings.StateDirectory = filepath.Join(dbSettings.Directory, ".kdbxsync")
+		data := encodeTestDatabase(t, newFakeKeepassDatabase())
+		require.NoError(t, os.WriteFile(dbSettings.FullFilePath(), data, 0600))
+		// the local file matches neither side of the journal, so a recovery would restore the backup
+		require.NoError(t, os.MkdirAll(dbSettings.BackupDirectory, 0700))
+		backup := filepath.Join(dbSettings.BackupDirectory, "2024-01-01T00-00-00-testfile.kdbx")
+		require.NoError(t, os.WriteFile(backup, []byte("previous db"), 0600))
+		require.NoError(t, keepass.WriteReplacingJournal(dbSettings, []byte("previous db"), []byte("merged db"), backup))
+
+		dbSync, err := keepass.InitKeepassDBDryRun(appSettings, &fakeStorage{data: data})
+		require.NoError(t, err)
+		defer dbSync.Close()
+		_, err = dbSync.DryRun()
+
+		require.NoError(t, err)
+		local, err := os.ReadFile(dbSettings.FullFilePath())
+		require.NoError(t, err)
+		assert.Equal(t, data, local)
+		_, err = os.Stat(dbSettings.FullJournalFilePath())
+		assert.NoError(t, err)
+	})
+
+	t.Run("success: nothing is created for a database which was never synced", func(t *testing.T) {
+		appSettings := newTestSettings(t)
+		dbSettings := appSettings.DatabaseSettings
+		dbSettings.StateDirectory = filepath.Join(dbSettings.Directory, ".kdbxsync")
+		data := encodeTestDatabase(t, newFakeKeepassDatabase())
+		require.NoError(t, os.WriteFile(dbSettings.FullFilePath(), data, 0600))
+
+		dbSync, err := keepass.InitKeepassDBDryRun(appSettings, &fakeStorage{data: data})
+		require.NoError(t, err)
+		_, err = dbSync.DryRun()
+		require.NoError(t, err)
+		require.NoError(t, dbSync.Close())
+
+		_, err = os.Stat(dbSettings.StateDirectory)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("error: dry run waits for a sync holding the lock", func(t *testing.T) {
+		appSettings := newTestSettings(t)
+		dbSettings := appSettings.DatabaseSettings
+		dbSettings.StateDirectory = filepath.Join(dbSettings.Directory, ".kdbxsync")
+		lock, err := keepass.AcquireSyncLock(dbSettings)
+		require.NoError(t, err)
+		defer lock.Release()
+
+		_, err = keepass.InitKeepassDBDryRun(appSettings, &fakeStorage{})
+
+		assert.ErrorContains(t, err, "another kdbxsync run")
+	})
+}
@@ -0,0 +1,87 @@
+package keepass
+
+import (
+	"fmt"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// names of built-in conflict resolution strategies used in settings
+const (
+	NewestWinsStrategy = "newest"
+	LocalWinsStrategy  = "local"
+	RemoteWinsStrategy = "remote"
+	KeepBothStrategy   = "keep-both"
+	FieldMergeStrategy = "field-merge"
+)
+
+// EntryConflict is an entry modified in both bases since the last sync
+type EntryConflict struct {
+	// Base is the version from the last synced state, nil when there is none
+	Base   *gokeepasslib.Entry
+	Local  gokeepasslib.Entry
+	Remote gokeepasslib.Entry
+}
+
+// Resolution is the outcome of a resolved conflict
+type Resolution struct {
+	// Entry replaces the conflicting entry, histories of both versions are merged into it
+	Entry gokeepasslib.Entry
+	// Duplicates are extra entries stored in the same group as the resolved entry
+	Duplicates []gokeepasslib.Entry
+	// Conflicts are versions which couldn't be merged safely, they are stored in the conflicts group
+	Conflicts []gokeepasslib.Entry
+}
+
+type ConflictResolver interface {
+	Resolve(conflict EntryConflict) Resolution
+}
+
+// ConflictResolverFunc allows to use an ordinary function as a ConflictResolver
+type ConflictResolverFunc func(conflict EntryConflict) Resolution
+
+func (resolve ConflictResolverFunc) Resolve(conflict EntryConflict) Resolution {
+	return resolve(conflict)
+}
+
+func newestWins(conflict EntryConflict) Resolution {
+	if isNewer(conflict.Remote.Times, conflict.Local.Times) {
+		return Resolution{Entry: conflict.Remote}
+	}
+	return Resolution{Entry: conflict.Local}
+}
+
+func localWins(conflict EntryConflict) Resolution {
+	return Resolution{Entry: conflict.Local}
+}
+
+func remoteWins(conflict EntryConflict) Resolution {
+	return Resolution{Entry: conflict.Remote}
+}
+
+// keepBoth keeps the local version in place and the remote one as a duplicate with a new uuid
+func keepBoth(conflict EntryConflict) Resolution {
+	duplicate := copyEntry(conflict.Remote)
+	duplicate.UUID = gokeepasslib.NewUUID()
+	duplicate.Histories = nil
+
+	return Resolution{Entry: conflict.Local, Duplicates: []gokeepasslib.Entry{duplicate}}
+}
+
+// NewConflictResolver returns one of built-in conflict resolution strategies, empty name means field merge
+func NewConflictResolver(strategy string) (ConflictResolver, error) {
+	switch strategy {
+	case NewestWinsStrategy:
+		return ConflictResolverFunc(newestWins), nil
+	case LocalWinsStrategy:
+		return ConflictResolverFunc(localWins), nil
+	case RemoteWinsStrategy:
+		return ConflictResolverFunc(remoteWins), nil
+	case KeepBothStrategy:
+		return ConflictResolverFunc(keepBoth), nil
+	case FieldMergeStrategy, "":
+		return ConflictResolverFunc(fieldMerge), nil
+	}
+
+	return nil, fmt.Errorf("unknown conflict strategy: %s", strategy)
+}
@@ -0,0 +1,104 @@
+package keepass_test
+
+import (
+	"testing"
+	"time"
+
+	"kdbxsync/keepass"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+func TestConflictResolvers(t *testing.T) {
+	rootID := gokeepasslib.NewUUID()
+	entryID := gokeepasslib.NewUUID()
+
+	newDatabase := func(modified time.Time, values ...gokeepasslib.ValueData) *gokeepasslib.Database {
+		root := mkGroup(rootID, "Root", baseTime)
+		entry := gokeepasslib.NewEntry()
+		entry.UUID = entryID
+		entry.Times = mkTimes(modified)
+		entry.Values = values
+		root.Entries = append(root.Entries, entry)
+		return newTestDatabase(root)
+	}
+	withStrategy := func(strategy string) func(dbSync *keepass.DBSync) {
+		return func(dbSync *keepass.DBSync) {
+			resolver, err := keepass.NewConflictResolver(strategy)
+			require.NoError(t, err)
+			dbSync.SetConflictResolver(resolver)
+		}
+	}
+	base := newDatabase(baseTime, mkValue("Title", "Entry"), mkValue("URL", "old"), mkProtectedValue("Password", "old"))
+	local := newDatabase(
+		baseTime.Add(2*time.Hour),
+		mkValue("Title", "Entry"), mkValue("URL", "new"), mkProtectedValue("Password", "old"),
+	)
+	remote := newDatabase(
+		baseTime.Add(time.Hour),
+		mkValue("Title", "Entry"), mkValue("URL", "old"), mkProtectedValue("Password", "new"),
+	)
+
+	t.Run("success: newest wins", func(t *testing.T) {
+		syncDB := mergeTestDatabases(t, base, local, remote, withStrategy(keepass.NewestWinsStrategy))
+		entries := syncDB.Content.Root.Groups[0].Entries
+
+		require.Len(t, entries, 1)
+		assert.Equal(t, "new", entries[0].GetContent("URL"))
+		assert.Equal(t, "old", entries[0].GetPassword())
+	})
+
+	t.Run("success: remote wins", func(t *testing.T) {
+		syncDB := mergeTestDatabases(t, base, local, remote, withStrategy(keepass.RemoteWinsStrategy))
+		entries := syncDB.Content.Root.Groups[0].Entries
+
+		require.Len(t, entries, 1)
+		assert.Equal(t, "old", entries[0].GetContent("URL"))
+		assert.Equal(t, "new", entries[0].GetPassword())
+	})
+
+	t.Run("success: keep both", func(t *testing.T) {
+		syncDB := mergeTestDatabases(t, base, local, remote, withStrategy(keepass.KeepBothStrategy))
+		entries := syncDB.Content.Root.Groups[0].Entries
+
+		require.Len(t, entries, 2)
+		assert.Equal(t, entryID, entries[0].UUID)
+		assert.Equal(t, "new", entries[0].GetContent("URL"))
+		assert.NotEqual(t, entryID, entries[1].UUID)
+		assert.Equal(t, "new", entries[1].GetPassword())
+	})
+
+	t.Run("success: field merge", func(t *testing.T) {
+		syncDB := mergeTestDatabases(t, base, local, remote, withStrategy(keepass.FieldMergeStrategy))
+		entries := syncDB.Content.Root.Groups[0].Entries
+
+		require.Len(t, entries, 1)
+		assert.Equal(t, "new", entries[0].GetContent("URL"))
+		assert.Equal(t, "new", entries[0].GetPassword())
+	})
+
+	t.Run("success: custom resolver", func(t *testing.T) {
+		custom := func(dbSync *keepass.DBSync) {
+			dbSync.SetConflictResolver(keepass.ConflictResolverFunc(func(conflict keepass.EntryConflict) keepass.Resolution {
+				entry := conflict.Local
+				entry.Get("URL").Value.Content = "custom"
+				return keepass.Resolution{Entry: entry}
+			}))
+		}
+		syncDB := mergeTestDatabases(t, base, local, remote, custom)
+		entries := syncDB.Content.Root.Groups[0].Entries
+
+		require.Len(t, entries, 1)
+		assert.Equal(t, "custom", entries[0].GetContent("URL"))
+	})
+
+	t.Run("error: unknown strategy", func(t *testing.T) {
+		resolver, err := keepass.NewConflictResolver("unknown")
+
+		assert.Error(t, err)
+		assert.Nil(t, resolver)
+		assert.Equal(t, "unknown conflict strategy: unknown", err.Error())
+	})
+}
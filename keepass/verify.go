@@ -0,0 +1,144 @@
+package keepass
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// dbContent lists groups and entries of a DB by uuid, a uuid met twice is counted twice
+type dbContent struct {
+	groups  map[gokeepasslib.UUID]int
+	entries map[gokeepasslib.UUID]int
+}
+
+func contentOf(db *gokeepasslib.Database) *dbContent {
+	content := &dbContent{
+		groups:  make(map[gokeepasslib.UUID]int),
+		entries: make(map[gokeepasslib.UUID]int),
+	}
+	var addGroups func(groups []gokeepasslib.Group)
+	addGroups = func(groups []gokeepasslib.Group) {
+		for _, group := range groups {
+			content.groups[group.UUID]++
+			for _, entry := range group.Entries {
+				content.entries[entry.UUID]++
+			}
+			addGroups(group.Groups)
+		}
+	}
+	if db.Content.Root != nil {
+		addGroups(db.Content.Root.Groups)
+	}
+
+	return content
+}
+
+// verifyMerged decodes the written DB with the credentials of the merged one and checks that it holds
+// the same groups and entries and that every attachment reference resolves,
+// nothing may be replaced or uploaded unless it passes
+func (keepassDBSync *DBSync) verifyMerged(data []byte) error {
+	merged := keepassDBSync.syncKeepassDB
+	written, err := decodeWritten(data, merged.Credentials)
+	if err != nil {
+		return fmt.Errorf("can't decode written DB: %w", err)
+	}
+	err = written.UnlockProtectedEntries()
+	if err != nil {
+		return fmt.Errorf("can't unlock protected entries of written DB: %w", err)
+	}
+
+	expected, actual := contentOf(merged), contentOf(written)
+	if len(expected.groups) != len(actual.groups) || len(expected.entries) != len(actual.entries) {
+		return fmt.Errorf(
+			"written DB has %d groups and %d entries, merged one has %d groups and %d entries",
+			len(actual.groups),
+			len(actual.entries),
+			len(expected.groups),
+			len(expected.entries),
+		)
+	}
+	for id, count := range expected.groups {
+		if actual.groups[id] != count {
+			return fmt.Errorf("group %x doesn't match in written DB", id)
+		}
+	}
+	for id, count := range expected.entries {
+		if actual.entries[id] != count {
+			return fmt.Errorf("entry %x doesn't match in written DB", id)
+		}
+	}
+
+	return verifyAttachments(written)
+}
+
+// decodeWritten decodes a DB which may be damaged, gokeepasslib panics on some broken files instead of failing
+func decodeWritten(data []byte, cred *gokeepasslib.DBCredentials) (db *gokeepasslib.Database, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			db, err = nil, fmt.Errorf("%v", recovered)
+		}
+	}()
+	db = gokeepasslib.NewDatabase()
+	db.Credentials = cred
+	err = gokeepasslib.NewDecoder(bytes.NewReader(data)).Decode(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// verifyAttachments checks that attachments of entries and their history are in the binary pool and readable
+func verifyAttachments(db *gokeepasslib.Database) error {
+	var verifyEntry func(entry gokeepasslib.Entry) error
+	verifyEntry = func(entry gokeepasslib.Entry) error {
+		for _, reference := range entry.Binaries {
+			binary := db.FindBinary(reference.Value.ID)
+			if binary == nil {
+				return fmt.Errorf(
+					"attachment %s of entry %x refers to missing binary %d",
+					reference.Name,
+					entry.UUID,
+					reference.Value.ID,
+				)
+			}
+			_, err := binaryContent(db, binary)
+			if err != nil {
+				return fmt.Errorf("can't read attachment %s of entry %x: %w", reference.Name, entry.UUID, err)
+			}
+		}
+		for _, history := range entry.Histories {
+			for _, historyEntry := range history.Entries {
+				err := verifyEntry(historyEntry)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	var verifyGroups func(groups []gokeepasslib.Group) error
+	verifyGroups = func(groups []gokeepasslib.Group) error {
+		for _, group := range groups {
+			for _, entry := range group.Entries {
+				err := verifyEntry(entry)
+				if err != nil {
+					return err
+				}
+			}
+			err := verifyGroups(group.Groups)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if db.Content.Root == nil {
+		return nil
+	}
+
+	return verifyGroups(db.Content.Root.Groups)
+}
@@ -0,0 +1,84 @@
+package keepass_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"kdbxsync/keepass"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+func TestVerifyMerged(t *testing.T) {
+	newMergedSync := func(t *testing.T) (*keepass.DBSync, []byte) {
+		remote := newFakeKeepassDatabase()
+		localData := encodeTestDatabase(t, remote)
+		remote.Content.Root.Groups[0].Entries = append(
+			remote.Content.Root.Groups[0].Entries,
+			mkEntry(gokeepasslib.NewUUID(), "Remote", "remote", baseTime),
+		)
+		remoteStorage := &fakeStorage{data: encodeTestDatabase(t, remote)}
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(localData),
+			bytes.NewReader(remoteStorage.data),
+			remoteStorage,
+			newTestSettings(t),
+		)
+		require.NoError(t, err)
+		data, err := dbSync.Merged()
+		require.NoError(t, err)
+		return dbSync, data
+	}
+
+	t.Run("success: written DB matches the merge", func(t *testing.T) {
+		dbSync, data := newMergedSync(t)
+
+		assert.NoError(t, dbSync.VerifyMerged(data))
+	})
+
+	t.Run("error: written DB doesn't decrypt", func(t *testing.T) {
+		dbSync, data := newMergedSync(t)
+
+		err := dbSync.VerifyMerged(data[:len(data)/2])
+
+		assert.ErrorContains(t, err, "can't decode written DB")
+	})
+
+	t.Run("error: written DB misses an entry", func(t *testing.T) {
+		dbSync, _ := newMergedSync(t)
+
+		err := dbSync.VerifyMerged(encodeTestDatabase(t, newFakeKeepassDatabase()))
+
+		assert.EqualError(t, err, "written DB has 1 groups and 1 entries, merged one has 1 groups and 2 entries")
+	})
+
+	t.Run("error: attachment refers to a missing binary", func(t *testing.T) {
+		rootID := gokeepasslib.NewUUID()
+		entryID := gokeepasslib.NewUUID()
+		newBase := func() *gokeepasslib.Database {
+			root := mkGroup(rootID, "Root", baseTime)
+			root.Entries = append(root.Entries, mkEntry(entryID, "Server", "secret", baseTime))
+			return newTestDatabase(root)
+		}
+		localData := encodeTestDatabase(t, newBase())
+		dbSync, err := keepass.NewKeepassDBSync(
+			bytes.NewReader(localData),
+			bytes.NewReader(localData),
+			&fakeStorage{data: localData},
+			newTestSettings(t),
+		)
+		require.NoError(t, err)
+		_, err = dbSync.Merged()
+		require.NoError(t, err)
+		broken := newBase()
+		entry := &broken.Content.Root.Groups[0].Entries[0]
+		entry.Binaries = append(entry.Binaries, gokeepasslib.Binary{ID: 7}.CreateReference("id_rsa"))
+
+		err = dbSync.VerifyMerged(encodeTestDatabase(t, broken))
+
+		assert.EqualError(t, err, fmt.Sprintf("attachment id_rsa of entry %x refers to missing binary 7", entryID))
+	})
+}
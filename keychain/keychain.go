@@ -38,56 +38,88 @@ func (keychainAccess *Access) validateFields() error {
 	return nil
 }
 
-func (keychainAccess Access) newKeychainPass(pass string) error {
-	newPass := keychain.NewGenericPassword(
+// keyFileAccount is the keychain account the key file is kept under
+func (keychainAccess Access) keyFileAccount() string {
+	return fmt.Sprintf("%s_key_file", keychainAccess.Account)
+}
+
+func (keychainAccess Access) newKeychainItem(account string, data []byte) error {
+	newItem := keychain.NewGenericPassword(
 		keychainAccess.Service,
-		keychainAccess.Account,
-		keychainAccess.Label, []byte(pass),
+		account,
+		keychainAccess.Label, data,
 		keychainAccess.AccessGroup,
 	)
-	newPass.SetSynchronizable(keychain.SynchronizableNo)
-	newPass.SetAccessible(keychain.AccessibleAccessibleAlwaysThisDeviceOnly)
+	newItem.SetSynchronizable(keychain.SynchronizableNo)
+	newItem.SetAccessible(keychain.AccessibleAccessibleAlwaysThisDeviceOnly)
 
-	err := keychain.AddItem(newPass)
+	err := keychain.AddItem(newItem)
 	if err != nil {
-		return fmt.Errorf("can't add password to the keychain: %w", err)
+		return fmt.Errorf("can't add item to the keychain: %w", err)
 	}
 
 	return nil
 }
 
-func (keychainAccess Access) getKeychainPass() (string, error) {
+func (keychainAccess Access) getKeychainItem(account string) ([]byte, error) {
 	resp, err := keychain.GetGenericPassword(
 		keychainAccess.Service,
-		keychainAccess.Account,
+		account,
 		keychainAccess.Label, keychainAccess.AccessGroup,
 	)
 	if err != nil {
-		return "", fmt.Errorf("can't get password from keychain: %w", err)
+		return nil, fmt.Errorf("can't get item from keychain: %w", err)
+	}
+	return resp, nil
+}
+
+func (keychainAccess Access) newKeychainPass(pass string) error {
+	return keychainAccess.newKeychainItem(keychainAccess.Account, []byte(pass))
+}
+
+func (keychainAccess Access) getKeychainPass() (string, error) {
+	resp, err := keychainAccess.getKeychainItem(keychainAccess.Account)
+	if err != nil {
+		return "", err
 	} else if len(resp) < 1 {
 		return "", nil
 	}
 	return string(resp[:]), nil
 }
 
+// GetKeyFile returns the key file kept in the keychain, on the first run the key file is read
+// from the path and added to the keychain so it can be removed from disk afterwards
+func (keychainAccess Access) GetKeyFile(path string) ([]byte, error) {
+	keyData, err := keychainAccess.getKeychainItem(keychainAccess.keyFileAccount())
+	if err != nil {
+		return nil, fmt.Errorf("can't get key file: %w", err)
+	}
+	if len(keyData) > 0 {
+		return keyData, nil
+	}
+	if path == "" {
+		return nil, errors.New("key file is missing in the keychain")
+	}
+
+	keyData, err = os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read key file: %w", err)
+	}
+	err = keychainAccess.newKeychainItem(keychainAccess.keyFileAccount(), keyData)
+	if err != nil {
+		return nil, fmt.Errorf("can't add key file to keychain: %w", err)
+	}
+
+	return keyData, nil
+}
+
 func (keychainAccess Access) GetPassword(callbackHTTPServer HTTPServer) (string, error) {
 	pass, err := keychainAccess.getKeychainPass()
 	if err != nil {
 		return "", fmt.Errorf("can't get pass: %w", err)
 	}
 	if pass == "" {
-		// TODO: remove hardcode
-		url := "http://localhost:3030/missing_pass"
-		// run goroutine to listen for callback
-		go callbackHTTPServer.RunHTTPServer()
-		// open localhost in browser to get pass from user *specific for macos
-		command := exec.Command("open", url)
-		commandErr := command.Run()
-		if commandErr != nil {
-			return "", fmt.Errorf("can't exec: %w", commandErr)
-		}
-		// get the code from callback
-		pass, err = callbackHTTPServer.ReadChannels()
+		pass, err = keychainAccess.PromptPassword(callbackHTTPServer)
 		if err != nil {
 			return "", err
 		}
@@ -100,6 +132,32 @@ func (keychainAccess Access) GetPassword(callbackHTTPServer HTTPServer) (string,
 	return pass, nil
 }
 
+// PromptPassword asks the user for the password in the browser, the password is not stored
+func (keychainAccess Access) PromptPassword(callbackHTTPServer HTTPServer) (string, error) {
+	// TODO: remove hardcode
+	url := "http://localhost:3030/missing_pass"
+	// run goroutine to listen for callback
+	go callbackHTTPServer.RunHTTPServer()
+	// open localhost in browser to get pass from user *specific for macos
+	command := exec.Command("open", url)
+	commandErr := command.Run()
+	if commandErr != nil {
+		return "", fmt.Errorf("can't exec: %w", commandErr)
+	}
+	// get the code from callback
+	return callbackHTTPServer.ReadChannels()
+}
+
+// SavePassword replaces the password stored in the keychain
+func (keychainAccess Access) SavePassword(pass string) error {
+	err := keychain.DeleteGenericPasswordItem(keychainAccess.Service, keychainAccess.Account)
+	if err != nil && err != keychain.ErrorItemNotFound {
+		return fmt.Errorf("can't remove old password from keychain: %w", err)
+	}
+
+	return keychainAccess.newKeychainPass(pass)
+}
+
 func readKeychaiAccess(path string) (*Access, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"kdbxsync/keychain"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
 type HTTPServer interface {
@@ -12,8 +15,56 @@ type HTTPServer interface {
 	ReadChannels() (string, error)
 }
 
+type KeyFileStorage interface {
+	GetKeyFile(path string) ([]byte, error)
+}
+
 type KeyStorage interface {
 	GetPassword(HTTPServer) (string, error)
+	KeyFileStorage
+}
+
+// ways to open the database
+const (
+	PasswordAuth           = "password"
+	KeyFileAuth            = "key-file"
+	PasswordAndKeyFileAuth = "password-and-key-file"
+)
+
+// output formats of the merged database
+const (
+	KDBX31 = "3.1"
+	KDBX4  = "4"
+
+	CipherAES256   = "aes256"
+	CipherChaCha20 = "chacha20"
+
+	KDFAES    = "aes-kdf"
+	KDFArgon2 = "argon2d"
+)
+
+// OutputFormat forces header settings of the merged database,
+// empty values keep the strongest settings found in the bases
+type OutputFormat struct {
+	Version string
+	Cipher  string
+	KDF     string
+	// AES-KDF transform rounds
+	Rounds uint64
+	// Argon2 parameters, memory is in bytes
+	Iterations  uint64
+	Memory      uint64
+	Parallelism uint32
+}
+
+// SyncLimits stop a sync which would lose too much of the database, e.g. when a truncated replica is merged,
+// zero values keep default limits
+type SyncLimits struct {
+	// entries the merged database may lose versus any of the bases
+	MaxDeletedEntries uint64
+	MaxDeletedPercent uint64
+	// how much smaller in bytes the merged database may be than any of the bases
+	MaxShrinkPercent uint64
 }
 
 type EnvVars struct {
@@ -34,57 +85,300 @@ func GetEnvs(directoryEnv string, dbFileNameEnv string) (*EnvVars, error) {
 	return &EnvVars{Directory: directory, DBFileName: dbFileName}, nil
 }
 
+func getEnvOrDefault(name string, defaultValue string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvList splits a variable in the same way as PATH, empty items are skipped
+func getEnvList(name string) []string {
+	var values []string
+	for _, value := range filepath.SplitList(os.Getenv(name)) {
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getAuthMode reads the way to open the database, by default a key file is used along with the password when it's set
+func getAuthMode(keyFile string) (string, error) {
+	defaultAuthMode := PasswordAuth
+	if keyFile != "" {
+		defaultAuthMode = PasswordAndKeyFileAuth
+	}
+	authMode := getEnvOrDefault("KEEPASS_AUTH_MODE", defaultAuthMode)
+	switch authMode {
+	case PasswordAuth, KeyFileAuth, PasswordAndKeyFileAuth:
+		return authMode, nil
+	}
+
+	return "", fmt.Errorf("unknown auth mode: %s", authMode)
+}
+
+// getKeyData reads the key file kept in the secret store, it's nil when the key file is read from disk
+func getKeyData(keyStorage KeyFileStorage, authMode string, keyFile string) ([]byte, error) {
+	if authMode == PasswordAuth {
+		return nil, nil
+	}
+	if os.Getenv("KEEPASS_KEY_FILE_IN_KEYCHAIN") == "true" {
+		keyData, err := keyStorage.GetKeyFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't get keepass db key file: %w", err)
+		}
+		return keyData, nil
+	}
+	if keyFile == "" {
+		return nil, errors.New("can't find key file variable")
+	}
+
+	return nil, nil
+}
+
+// getEnvUint reads a positive number, it's 0 when the variable is not set
+func getEnvUint(name string, bitSize int) (uint64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	number, err := strconv.ParseUint(value, 10, bitSize)
+	if err != nil || number == 0 {
+		return 0, fmt.Errorf("%s should be a positive number: %s", name, value)
+	}
+	return number, nil
+}
+
+// getEnvDuration reads a duration like "30s" or "2m", it's 0 when the variable is not set
+func getEnvDuration(name string) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("%s should be a duration like 30s or 2m: %s", name, value)
+	}
+	return duration, nil
+}
+
+// getOutputFormat reads the forced format of the merged database
+func getOutputFormat() (OutputFormat, error) {
+	format := OutputFormat{
+		Version: os.Getenv("KEEPASS_FORMAT_VERSION"),
+		Cipher:  os.Getenv("KEEPASS_CIPHER"),
+		KDF:     os.Getenv("KEEPASS_KDF"),
+	}
+	switch format.Version {
+	case "", KDBX31, KDBX4:
+	default:
+		return OutputFormat{}, fmt.Errorf("unknown kdbx version: %s", format.Version)
+	}
+	switch format.Cipher {
+	case "", CipherAES256, CipherChaCha20:
+	default:
+		return OutputFormat{}, fmt.Errorf("unknown cipher: %s", format.Cipher)
+	}
+	switch format.KDF {
+	case "", KDFAES, KDFArgon2:
+	default:
+		return OutputFormat{}, fmt.Errorf("unknown kdf: %s", format.KDF)
+	}
+	if format.Version == KDBX31 && (format.Cipher == CipherChaCha20 || format.KDF == KDFArgon2) {
+		return OutputFormat{}, fmt.Errorf("kdbx %s supports only %s cipher and %s", KDBX31, CipherAES256, KDFAES)
+	}
+
+	var err error
+	format.Rounds, err = getEnvUint("KEEPASS_KDF_ROUNDS", 64)
+	if err != nil {
+		return OutputFormat{}, err
+	}
+	format.Iterations, err = getEnvUint("KEEPASS_KDF_ITERATIONS", 32)
+	if err != nil {
+		return OutputFormat{}, err
+	}
+	memory, err := getEnvUint("KEEPASS_KDF_MEMORY", 32)
+	if err != nil {
+		return OutputFormat{}, err
+	}
+	// memory is set in MiB
+	format.Memory = memory * 1024 * 1024
+	parallelism, err := getEnvUint("KEEPASS_KDF_PARALLELISM", 8)
+	if err != nil {
+		return OutputFormat{}, err
+	}
+	format.Parallelism = uint32(parallelism)
+
+	return format, nil
+}
+
+// getSyncLimits reads limits of a sync, percents can't be above 100
+func getSyncLimits() (SyncLimits, error) {
+	var limits SyncLimits
+	var err error
+	limits.MaxDeletedEntries, err = getEnvUint("KEEPASS_MAX_DELETED_ENTRIES", 64)
+	if err != nil {
+		return SyncLimits{}, err
+	}
+	percents := []struct {
+		name  string
+		value *uint64
+	}{
+		{name: "KEEPASS_MAX_DELETED_PERCENT", value: &limits.MaxDeletedPercent},
+		{name: "KEEPASS_MAX_SHRINK_PERCENT", value: &limits.MaxShrinkPercent},
+	}
+	for _, percent := range percents {
+		*percent.value, err = getEnvUint(percent.name, 64)
+		if err != nil {
+			return SyncLimits{}, err
+		}
+		if *percent.value > 100 {
+			return SyncLimits{}, fmt.Errorf("%s should be a percent from 1 to 100: %d", percent.name, *percent.value)
+		}
+	}
+
+	return limits, nil
+}
+
 type DataBaseSettings struct {
 	Directory        string
 	FileName         string
 	Password         string
-	RemoteCopyPrefix string
-	SyncDBName       string
 	BackupDirectory  string
+	StateDirectory   string
+	ConflictStrategy string
+	AuthMode         string
+	// path to the key file
+	KeyFile string
+	// content of the key file when it's kept in the secret store
+	KeyData []byte
+	// paths to additional copies of the database, e.g. on a NAS share or a USB stick
+	Replicas []string
+	// header settings the merged database is written with
+	OutputFormat OutputFormat
+	// how long to wait for another run to release the sync lock, 0 fails at once
+	LockTimeout time.Duration
+	// a sync which would lose more is refused
+	Limits SyncLimits
 }
 
 func (dbSettings *DataBaseSettings) FullFilePath() string {
 	return fmt.Sprintf("%s/%s", dbSettings.Directory, dbSettings.FileName)
 }
 
-func (dbSettings *DataBaseSettings) FullRemoteCopyFilePath() string {
-	return fmt.Sprintf("%s/%s_%s", dbSettings.Directory, dbSettings.RemoteCopyPrefix, dbSettings.FileName)
+func (dbSettings *DataBaseSettings) FullSnapshotFilePath() string {
+	return fmt.Sprintf("%s/snapshot_%s", dbSettings.StateDirectory, dbSettings.FileName)
+}
+
+func (dbSettings *DataBaseSettings) FullSyncedReplicasFilePath() string {
+	return fmt.Sprintf("%s/replicas_%s.json", dbSettings.StateDirectory, dbSettings.FileName)
+}
+
+func (dbSettings *DataBaseSettings) FullJournalFilePath() string {
+	return fmt.Sprintf("%s/journal_%s.json", dbSettings.StateDirectory, dbSettings.FileName)
 }
 
-func (dbSettings *DataBaseSettings) FullSyncFilePath() string {
-	return fmt.Sprintf("%s/%s", dbSettings.Directory, dbSettings.SyncDBName)
+func (dbSettings *DataBaseSettings) FullLockFilePath() string {
+	return fmt.Sprintf("%s/lock_%s", dbSettings.StateDirectory, dbSettings.FileName)
 }
 
 func NewDatabaseSetting(
 	keychainAccess KeyStorage,
 	httpServer HTTPServer,
 ) (*DataBaseSettings, error) {
-	pass, err := keychainAccess.GetPassword(httpServer)
+	keyFile := os.Getenv("KEEPASS_KEY_FILE")
+	authMode, err := getAuthMode(keyFile)
 	if err != nil {
-		return nil, fmt.Errorf("can't get keepass db password: %w", err)
+		return nil, err
+	}
+	var pass string
+	if authMode != KeyFileAuth {
+		pass, err = keychainAccess.GetPassword(httpServer)
+		if err != nil {
+			return nil, fmt.Errorf("can't get keepass db password: %w", err)
+		}
+	}
+	keyData, err := getKeyData(keychainAccess, authMode, keyFile)
+	if err != nil {
+		return nil, err
 	}
 
 	envVars, err := GetEnvs("KEEPASS_DB_DIRECTORY", "KEEPASS_DB_FILE_NAME")
 	if err != nil {
 		return nil, err
 	}
+	outputFormat, err := getOutputFormat()
+	if err != nil {
+		return nil, err
+	}
+	lockTimeout, err := getEnvDuration("KEEPASS_LOCK_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	limits, err := getSyncLimits()
+	if err != nil {
+		return nil, err
+	}
 
 	dbSettings := DataBaseSettings{
 		Directory:        envVars.Directory,
 		FileName:         envVars.DBFileName,
 		Password:         pass,
-		RemoteCopyPrefix: "remote_copy",
-		SyncDBName:       "tmp.kdbx",
 		BackupDirectory:  fmt.Sprintf("%s/backups", envVars.Directory),
+		StateDirectory:   fmt.Sprintf("%s/.kdbxsync", envVars.Directory),
+		ConflictStrategy: getEnvOrDefault("KEEPASS_CONFLICT_STRATEGY", "field-merge"),
+		AuthMode:         authMode,
+		KeyFile:          keyFile,
+		KeyData:          keyData,
+		Replicas:         getEnvList("KEEPASS_REPLICAS"),
+		OutputFormat:     outputFormat,
+		LockTimeout:      lockTimeout,
+		Limits:           limits,
 	}
 
 	return &dbSettings, nil
 }
 
+// PasswordProvider asks the user for a database password and keeps it in the secret store
+type PasswordProvider interface {
+	PromptPassword() (string, error)
+	SavePassword(pass string) error
+}
+
+type keychainPasswords struct {
+	keychainAccess *keychain.Access
+	httpServer     HTTPServer
+}
+
+func (passwords *keychainPasswords) PromptPassword() (string, error) {
+	return passwords.keychainAccess.PromptPassword(passwords.httpServer)
+}
+
+func (passwords *keychainPasswords) SavePassword(pass string) error {
+	return passwords.keychainAccess.SavePassword(pass)
+}
+
+// keychainKeys reads the password and the key file of the database from the keychain
+type keychainKeys struct {
+	keychainAccess *keychain.Access
+}
+
+func (keys *keychainKeys) GetPassword(httpServer HTTPServer) (string, error) {
+	return keys.keychainAccess.GetPassword(httpServer)
+}
+
+func (keys *keychainKeys) GetKeyFile(path string) ([]byte, error) {
+	return keys.keychainAccess.GetKeyFile(path)
+}
+
 type AppSettings struct {
 	HTTPServer         HTTPServer
 	DatabaseSettings   *DataBaseSettings
 	StorageCredentials string
+	// asks for the password of a remote base with a different master key, can be nil
+	Passwords PasswordProvider
 }
 
 func InitAppSettings(
@@ -95,25 +389,13 @@ func InitAppSettings(
 	appSettings := AppSettings{
 		HTTPServer:         httpServer,
 		StorageCredentials: storageCredentials,
+		Passwords:          &keychainPasswords{keychainAccess: keychainAccess, httpServer: httpServer},
 	}
-	pass, err := keychainAccess.GetPassword(httpServer)
-	if err != nil {
-		return nil, fmt.Errorf("can't get keepass db password: %w", err)
-	}
-
-	envVars, err := GetEnvs("KEEPASS_DB_DIRECTORY", "KEEPASS_DB_FILE_NAME")
+	dbSettings, err := NewDatabaseSetting(&keychainKeys{keychainAccess: keychainAccess}, httpServer)
 	if err != nil {
 		return nil, err
 	}
-
-	appSettings.DatabaseSettings = &DataBaseSettings{
-		Directory:        envVars.Directory,
-		FileName:         envVars.DBFileName,
-		Password:         pass,
-		RemoteCopyPrefix: "remote_copy",
-		SyncDBName:       "tmp.kdbx",
-		BackupDirectory:  fmt.Sprintf("%s/backups", envVars.Directory),
-	}
+	appSettings.DatabaseSettings = dbSettings
 
 	return &appSettings, nil
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"kdbxsync/settings"
 
@@ -13,6 +14,7 @@ import (
 
 type FakeKeychainAccess struct {
 	password string
+	keyData  []byte
 	err      error
 }
 
@@ -20,6 +22,10 @@ func (f *FakeKeychainAccess) GetPassword(server settings.HTTPServer) (string, er
 	return f.password, f.err
 }
 
+func (f *FakeKeychainAccess) GetKeyFile(path string) ([]byte, error) {
+	return f.keyData, f.err
+}
+
 type FakeHTTPServer struct{}
 
 func (fhs *FakeHTTPServer) RunHTTPServer() {}
@@ -84,29 +90,43 @@ func TestDataBaseSettingsMethods(t *testing.T) {
 		directory := "dir/path"
 		fileNmae := "test.kdbx"
 		pass := "pass"
-		remoteCopyPrefix := "remote_copy"
-		syncDBName := "tmp.kdbx"
 		backupDir := "backup"
+		stateDir := "state"
 		dbSettings := settings.DataBaseSettings{
-			Directory:        directory,
-			FileName:         fileNmae,
-			Password:         pass,
-			RemoteCopyPrefix: remoteCopyPrefix,
-			SyncDBName:       syncDBName,
-			BackupDirectory:  backupDir,
+			Directory:       directory,
+			FileName:        fileNmae,
+			Password:        pass,
+			BackupDirectory: backupDir,
+			StateDirectory:  stateDir,
 		}
 
 		fullFilePath := dbSettings.FullFilePath()
-		fullRemoteCopyFilePath := dbSettings.FullRemoteCopyFilePath()
-		fullSyncFilePath := dbSettings.FullSyncFilePath()
+		fullSnapshotFilePath := dbSettings.FullSnapshotFilePath()
+		fullSyncedReplicasFilePath := dbSettings.FullSyncedReplicasFilePath()
+		fullJournalFilePath := dbSettings.FullJournalFilePath()
+		fullLockFilePath := dbSettings.FullLockFilePath()
 
 		assert.Equal(t, fullFilePath, fmt.Sprintf("%s/%s", dbSettings.Directory, dbSettings.FileName))
 		assert.Equal(
 			t,
-			fullRemoteCopyFilePath,
-			fmt.Sprintf("%s/%s_%s", dbSettings.Directory, dbSettings.RemoteCopyPrefix, dbSettings.FileName),
+			fullSnapshotFilePath,
+			fmt.Sprintf("%s/snapshot_%s", dbSettings.StateDirectory, dbSettings.FileName),
+		)
+		assert.Equal(
+			t,
+			fullSyncedReplicasFilePath,
+			fmt.Sprintf("%s/replicas_%s.json", dbSettings.StateDirectory, dbSettings.FileName),
+		)
+		assert.Equal(
+			t,
+			fullJournalFilePath,
+			fmt.Sprintf("%s/journal_%s.json", dbSettings.StateDirectory, dbSettings.FileName),
+		)
+		assert.Equal(
+			t,
+			fullLockFilePath,
+			fmt.Sprintf("%s/lock_%s", dbSettings.StateDirectory, dbSettings.FileName),
 		)
-		assert.Equal(t, fullSyncFilePath, fmt.Sprintf("%s/%s", dbSettings.Directory, dbSettings.SyncDBName))
 
 	})
 }
@@ -128,9 +148,279 @@ func TestNewDatabaseSetting(t *testing.T) {
 		assert.Equal(t, "/test/directory", dbSettings.Directory)
 		assert.Equal(t, "testfile.kdbx", dbSettings.FileName)
 		assert.Equal(t, "testpassword", dbSettings.Password)
-		assert.Equal(t, "remote_copy", dbSettings.RemoteCopyPrefix)
-		assert.Equal(t, "tmp.kdbx", dbSettings.SyncDBName)
 		assert.Equal(t, "/test/directory/backups", dbSettings.BackupDirectory)
+		assert.Equal(t, "/test/directory/.kdbxsync", dbSettings.StateDirectory)
+		assert.Equal(t, "field-merge", dbSettings.ConflictStrategy)
+		assert.Empty(t, dbSettings.Replicas)
+		assert.Equal(t, settings.PasswordAuth, dbSettings.AuthMode)
+	})
+
+	t.Run("success: password and key file", func(t *testing.T) {
+		os.Setenv("KEEPASS_DB_DIRECTORY", "/test/directory")
+		os.Setenv("KEEPASS_DB_FILE_NAME", "testfile.kdbx")
+		os.Setenv("KEEPASS_KEY_FILE", "/test/directory/testfile.keyx")
+		defer os.Unsetenv("KEEPASS_DB_DIRECTORY")
+		defer os.Unsetenv("KEEPASS_DB_FILE_NAME")
+		defer os.Unsetenv("KEEPASS_KEY_FILE")
+
+		fakeKeychainAccess := &FakeKeychainAccess{password: "testpassword", err: nil}
+		fakeHTTPServer := &FakeHTTPServer{}
+
+		dbSettings, err := settings.NewDatabaseSetting(fakeKeychainAccess, fakeHTTPServer)
+
+		assert.NoError(t, err)
+		assert.NotNil(t, dbSettings)
+		assert.Equal(t, settings.PasswordAndKeyFileAuth, dbSettings.AuthMode)
+		assert.Equal(t, "testpassword", dbSettings.Password)
+		assert.Equal(t, "/test/directory/testfile.keyx", dbSettings.KeyFile)
+		assert.Nil(t, dbSettings.KeyData)
+	})
+
+	t.Run("success: key file from keychain without password", func(t *testing.T) {
+		os.Setenv("KEEPASS_DB_DIRECTORY", "/test/directory")
+		os.Setenv("KEEPASS_DB_FILE_NAME", "testfile.kdbx")
+		os.Setenv("KEEPASS_AUTH_MODE", "key-file")
+		os.Setenv("KEEPASS_KEY_FILE_IN_KEYCHAIN", "true")
+		defer os.Unsetenv("KEEPASS_DB_DIRECTORY")
+		defer os.Unsetenv("KEEPASS_DB_FILE_NAME")
+		defer os.Unsetenv("KEEPASS_AUTH_MODE")
+		defer os.Unsetenv("KEEPASS_KEY_FILE_IN_KEYCHAIN")
+
+		fakeKeychainAccess := &FakeKeychainAccess{keyData: []byte("key"), err: nil}
+		fakeHTTPServer := &FakeHTTPServer{}
+
+		dbSettings, err := settings.NewDatabaseSetting(fakeKeychainAccess, fakeHTTPServer)
+
+		assert.NoError(t, err)
+		assert.NotNil(t, dbSettings)
+		assert.Equal(t, settings.KeyFileAuth, dbSettings.AuthMode)
+		assert.Empty(t, dbSettings.Password)
+		assert.Equal(t, []byte("key"), dbSettings.KeyData)
+	})
+
+	t.Run("error: key file is not set", func(t *testing.T) {
+		os.Setenv("KEEPASS_DB_DIRECTORY", "/test/directory")
+		os.Setenv("KEEPASS_DB_FILE_NAME", "testfile.kdbx")
+		os.Setenv("KEEPASS_AUTH_MODE", "key-file")
+		defer os.Unsetenv("KEEPASS_DB_DIRECTORY")
+		defer os.Unsetenv("KEEPASS_DB_FILE_NAME")
+		defer os.Unsetenv("KEEPASS_AUTH_MODE")
+
+		fakeKeychainAccess := &FakeKeychainAccess{password: "testpassword", err: nil}
+		fakeHTTPServer := &FakeHTTPServer{}
+
+		dbSettings, err := settings.NewDatabaseSetting(fakeKeychainAccess, fakeHTTPServer)
+
+		assert.Error(t, err)
+		assert.Nil(t, dbSettings)
+		assert.Equal(t, "can't find key file variable", err.Error())
+	})
+
+	t.Run("error: unknown auth mode", func(t *testing.T) {
+		os.Setenv("KEEPASS_DB_DIRECTORY", "/test/directory")
+		os.Setenv("KEEPASS_DB_FILE_NAME", "testfile.kdbx")
+		os.Setenv("KEEPASS_AUTH_MODE", "token")
+		defer os.Unsetenv("KEEPASS_DB_DIRECTORY")
+		defer os.Unsetenv("KEEPASS_DB_FILE_NAME")
+		defer os.Unsetenv("KEEPASS_AUTH_MODE")
+
+		fakeKeychainAccess := &FakeKeychainAccess{password: "testpassword", err: nil}
+		fakeHTTPServer := &FakeHTTPServer{}
+
+		dbSettings, err := settings.NewDatabaseSetting(fakeKeychainAccess, fakeHTTPServer)
+
+		assert.Error(t, err)
+		assert.Nil(t, dbSettings)
+		assert.Equal(t, "unknown auth mode: token", err.Error())
+	})
+
+	t.Run("success: replicas from env", func(t *testing.T) {
+		os.Setenv("KEEPASS_DB_DIRECTORY", "/test/directory")
+		os.Setenv("KEEPASS_DB_FILE_NAME", "testfile.kdbx")
+		os.Setenv("KEEPASS_REPLICAS", "/mnt/nas/testfile.kdbx::/Volumes/usb/testfile.kdbx")
+		defer os.Unsetenv("KEEPASS_DB_DIRECTORY")
+		defer os.Unsetenv("KEEPASS_DB_FILE_NAME")
+		defer os.Unsetenv("KEEPASS_REPLICAS")
+
+		fakeKeychainAccess := &FakeKeychainAccess{password: "testpassword", err: nil}
+		fakeHTTPServer := &FakeHTTPServer{}
+
+		dbSettings, err := settings.NewDatabaseSetting(fakeKeychainAccess, fakeHTTPServer)
+
+		assert.NoError(t, err)
+		assert.NotNil(t, dbSettings)
+		assert.Equal(t, []string{"/mnt/nas/testfile.kdbx", "/Volumes/usb/testfile.kdbx"}, dbSettings.Replicas)
+	})
+
+	t.Run("success: output format from env", func(t *testing.T) {
+		os.Setenv("KEEPASS_DB_DIRECTORY", "/test/directory")
+		os.Setenv("KEEPASS_DB_FILE_NAME", "testfile.kdbx")
+		os.Setenv("KEEPASS_FORMAT_VERSION", "4")
+		os.Setenv("KEEPASS_CIPHER", "chacha20")
+		os.Setenv("KEEPASS_KDF", "argon2d")
+		os.Setenv("KEEPASS_KDF_ITERATIONS", "5")
+		os.Setenv("KEEPASS_KDF_MEMORY", "128")
+		os.Setenv("KEEPASS_KDF_PARALLELISM", "4")
+		defer os.Unsetenv("KEEPASS_DB_DIRECTORY")
+		defer os.Unsetenv("KEEPASS_DB_FILE_NAME")
+		defer os.Unsetenv("KEEPASS_FORMAT_VERSION")
+		defer os.Unsetenv("KEEPASS_CIPHER")
+		defer os.Unsetenv("KEEPASS_KDF")
+		defer os.Unsetenv("KEEPASS_KDF_ITERATIONS")
+		defer os.Unsetenv("KEEPASS_KDF_MEMORY")
+		defer os.Unsetenv("KEEPASS_KDF_PARALLELISM")
+
+		fakeKeychainAccess := &FakeKeychainAccess{password: "testpassword", err: nil}
+		fakeHTTPServer := &FakeHTTPServer{}
+
+		dbSettings, err := settings.NewDatabaseSetting(fakeKeychainAccess, fakeHTTPServer)
+
+		assert.NoError(t, err)
+		assert.NotNil(t, dbSettings)
+		assert.Equal(t, settings.OutputFormat{
+			Version:     settings.KDBX4,
+			Cipher:      settings.CipherChaCha20,
+			KDF:         settings.KDFArgon2,
+			Iterations:  5,
+			Memory:      128 * 1024 * 1024,
+			Parallelism: 4,
+		}, dbSettings.OutputFormat)
+	})
+
+	t.Run("error: argon2 in kdbx 3.1", func(t *testing.T) {
+		os.Setenv("KEEPASS_DB_DIRECTORY", "/test/directory")
+		os.Setenv("KEEPASS_DB_FILE_NAME", "testfile.kdbx")
+		os.Setenv("KEEPASS_FORMAT_VERSION", "3.1")
+		os.Setenv("KEEPASS_KDF", "argon2d")
+		defer os.Unsetenv("KEEPASS_DB_DIRECTORY")
+		defer os.Unsetenv("KEEPASS_DB_FILE_NAME")
+		defer os.Unsetenv("KEEPASS_FORMAT_VERSION")
+		defer os.Unsetenv("KEEPASS_KDF")
+
+		fakeKeychainAccess := &FakeKeychainAccess{password: "testpassword", err: nil}
+		fakeHTTPServer := &FakeHTTPServer{}
+
+		dbSettings, err := settings.NewDatabaseSetting(fakeKeychainAccess, fakeHTTPServer)
+
+		assert.Error(t, err)
+		assert.Nil(t, dbSettings)
+		assert.Equal(t, "kdbx 3.1 supports only aes256 cipher and aes-kdf", err.Error())
+	})
+
+	t.Run("error: kdf rounds is not a number", func(t *testing.T) {
+		os.Setenv("KEEPASS_DB_DIRECTORY", "/test/directory")
+		os.Setenv("KEEPASS_DB_FILE_NAME", "testfile.kdbx")
+		os.Setenv("KEEPASS_KDF_ROUNDS", "many")
+		defer os.Unsetenv("KEEPASS_DB_DIRECTORY")
+		defer os.Unsetenv("KEEPASS_DB_FILE_NAME")
+		defer os.Unsetenv("KEEPASS_KDF_ROUNDS")
+
+		fakeKeychainAccess := &FakeKeychainAccess{password: "testpassword", err: nil}
+		fakeHTTPServer := &FakeHTTPServer{}
+
+		dbSettings, err := settings.NewDatabaseSetting(fakeKeychainAccess, fakeHTTPServer)
+
+		assert.Error(t, err)
+		assert.Nil(t, dbSettings)
+		assert.Equal(t, "KEEPASS_KDF_ROUNDS should be a positive number: many", err.Error())
+	})
+
+	t.Run("success: lock timeout from env", func(t *testing.T) {
+		os.Setenv("KEEPASS_DB_DIRECTORY", "/test/directory")
+		os.Setenv("KEEPASS_DB_FILE_NAME", "testfile.kdbx")
+		os.Setenv("KEEPASS_LOCK_TIMEOUT", "2m")
+		defer os.Unsetenv("KEEPASS_DB_DIRECTORY")
+		defer os.Unsetenv("KEEPASS_DB_FILE_NAME")
+		defer os.Unsetenv("KEEPASS_LOCK_TIMEOUT")
+
+		fakeKeychainAccess := &FakeKeychainAccess{password: "testpassword", err: nil}
+		fakeHTTPServer := &FakeHTTPServer{}
+
+		dbSettings, err := settings.NewDatabaseSetting(fakeKeychainAccess, fakeHTTPServer)
+
+		assert.NoError(t, err)
+		assert.NotNil(t, dbSettings)
+		assert.Equal(t, 2*time.Minute, dbSettings.LockTimeout)
+	})
+
+	t.Run("error: lock timeout is not a duration", func(t *testing.T) {
+		os.Setenv("KEEPASS_DB_DIRECTORY", "/test/directory")
+		os.Setenv("KEEPASS_DB_FILE_NAME", "testfile.kdbx")
+		os.Setenv("KEEPASS_LOCK_TIMEOUT", "forever")
+		defer os.Unsetenv("KEEPASS_DB_DIRECTORY")
+		defer os.Unsetenv("KEEPASS_DB_FILE_NAME")
+		defer os.Unsetenv("KEEPASS_LOCK_TIMEOUT")
+
+		fakeKeychainAccess := &FakeKeychainAccess{password: "testpassword", err: nil}
+		fakeHTTPServer := &FakeHTTPServer{}
+
+		dbSettings, err := settings.NewDatabaseSetting(fakeKeychainAccess, fakeHTTPServer)
+
+		assert.Error(t, err)
+		assert.Nil(t, dbSettings)
+		assert.Equal(t, "KEEPASS_LOCK_TIMEOUT should be a duration like 30s or 2m: forever", err.Error())
+	})
+
+	t.Run("success: sync limits from env", func(t *testing.T) {
+		os.Setenv("KEEPASS_DB_DIRECTORY", "/test/directory")
+		os.Setenv("KEEPASS_DB_FILE_NAME", "testfile.kdbx")
+		os.Setenv("KEEPASS_MAX_DELETED_ENTRIES", "100")
+		os.Setenv("KEEPASS_MAX_DELETED_PERCENT", "10")
+		os.Setenv("KEEPASS_MAX_SHRINK_PERCENT", "30")
+		defer os.Unsetenv("KEEPASS_DB_DIRECTORY")
+		defer os.Unsetenv("KEEPASS_DB_FILE_NAME")
+		defer os.Unsetenv("KEEPASS_MAX_DELETED_ENTRIES")
+		defer os.Unsetenv("KEEPASS_MAX_DELETED_PERCENT")
+		defer os.Unsetenv("KEEPASS_MAX_SHRINK_PERCENT")
+
+		fakeKeychainAccess := &FakeKeychainAccess{password: "testpassword", err: nil}
+		fakeHTTPServer := &FakeHTTPServer{}
+
+		dbSettings, err := settings.NewDatabaseSetting(fakeKeychainAccess, fakeHTTPServer)
+
+		assert.NoError(t, err)
+		assert.NotNil(t, dbSettings)
+		assert.Equal(t, settings.SyncLimits{
+			MaxDeletedEntries: 100,
+			MaxDeletedPercent: 10,
+			MaxShrinkPercent:  30,
+		}, dbSettings.Limits)
+	})
+
+	t.Run("error: percent limit above 100", func(t *testing.T) {
+		os.Setenv("KEEPASS_DB_DIRECTORY", "/test/directory")
+		os.Setenv("KEEPASS_DB_FILE_NAME", "testfile.kdbx")
+		os.Setenv("KEEPASS_MAX_SHRINK_PERCENT", "150")
+		defer os.Unsetenv("KEEPASS_DB_DIRECTORY")
+		defer os.Unsetenv("KEEPASS_DB_FILE_NAME")
+		defer os.Unsetenv("KEEPASS_MAX_SHRINK_PERCENT")
+
+		fakeKeychainAccess := &FakeKeychainAccess{password: "testpassword", err: nil}
+		fakeHTTPServer := &FakeHTTPServer{}
+
+		dbSettings, err := settings.NewDatabaseSetting(fakeKeychainAccess, fakeHTTPServer)
+
+		assert.Error(t, err)
+		assert.Nil(t, dbSettings)
+		assert.Equal(t, "KEEPASS_MAX_SHRINK_PERCENT should be a percent from 1 to 100: 150", err.Error())
+	})
+
+	t.Run("success: conflict strategy from env", func(t *testing.T) {
+		os.Setenv("KEEPASS_DB_DIRECTORY", "/test/directory")
+		os.Setenv("KEEPASS_DB_FILE_NAME", "testfile.kdbx")
+		os.Setenv("KEEPASS_CONFLICT_STRATEGY", "remote")
+		defer os.Unsetenv("KEEPASS_DB_DIRECTORY")
+		defer os.Unsetenv("KEEPASS_DB_FILE_NAME")
+		defer os.Unsetenv("KEEPASS_CONFLICT_STRATEGY")
+
+		fakeKeychainAccess := &FakeKeychainAccess{password: "testpassword", err: nil}
+		fakeHTTPServer := &FakeHTTPServer{}
+
+		dbSettings, err := settings.NewDatabaseSetting(fakeKeychainAccess, fakeHTTPServer)
+
+		assert.NoError(t, err)
+		assert.NotNil(t, dbSettings)
+		assert.Equal(t, "remote", dbSettings.ConflictStrategy)
 	})
 
 	t.Run("error when GetPassword fails", func(t *testing.T) {
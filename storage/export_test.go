@@ -0,0 +1,16 @@
+package storage
+
+import (
+	"kdbxsync/settings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// NewGoogleDriveStorage wraps a Drive service, e.g. one talking to a fake server
+func NewGoogleDriveStorage(service *drive.Service, appSettings *settings.AppSettings) *Storage {
+	controller := googleDriveController{
+		service:    service,
+		dbSettings: appSettings.DatabaseSettings,
+	}
+	return &Storage{Settings: appSettings, Service: &controller}
+}
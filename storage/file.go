@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"kdbxsync/keepass"
+)
+
+// tmp files of interrupted writes of a replica older than this are removed, newer ones
+// can belong to another device writing the replica right now
+const staleLeftoverAge = time.Hour
+
+// FileStorage keeps a replica of the database on a mounted file system like a NAS share or a USB stick
+type FileStorage struct {
+	path string
+	// version of the replica read by the sync, nil until it's read
+	version *fileVersion
+}
+
+// fileVersion tells whether the replica was rewritten by another device
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func versionOfFile(info os.FileInfo) *fileVersion {
+	return &fileVersion{modTime: info.ModTime(), size: info.Size()}
+}
+
+func (storage *FileStorage) Name() string {
+	return storage.path
+}
+
+// DownloadRemoteKeepassDB opens the replica in place
+func (storage *FileStorage) DownloadRemoteKeepassDB() (io.ReadCloser, error) {
+	fileObj, err := os.Open(storage.path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fileObj.Stat()
+	if err != nil {
+		fileObj.Close()
+		return nil, fmt.Errorf("can't get replica info: %w", err)
+	}
+	storage.version = versionOfFile(info)
+
+	return fileObj, nil
+}
+
+// UpdateDBFile replaces the replica with the merged DB, the new file is written next to the replica
+// and renamed over it so the replica is never left half written, a replica changed since it was read is kept
+func (storage *FileStorage) UpdateDBFile(data []byte) error {
+	info, err := os.Stat(storage.path)
+	if err != nil {
+		return fmt.Errorf("can't get replica info: %w", err)
+	}
+	if storage.version != nil && *versionOfFile(info) != *storage.version {
+		return fmt.Errorf("%w: %s was modified at %s", keepass.ErrRemoteChanged, storage.path, info.ModTime())
+	}
+	err = keepass.RemoveLeftovers(storage.path, staleLeftoverAge)
+	if err != nil {
+		return err
+	}
+	// the replica keeps its mode, e.g. a copy on a NAS share can be readable by other users
+	err = keepass.WriteFileAtomic(storage.path, data, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("can't replace replica: %w", err)
+	}
+	info, err = os.Stat(storage.path)
+	if err != nil {
+		return fmt.Errorf("can't get replica info: %w", err)
+	}
+	storage.version = versionOfFile(info)
+
+	return nil
+}
+
+// BackupDBFile copies the replica to the backups directory next to it
+func (storage *FileStorage) BackupDBFile() error {
+	data, err := os.ReadFile(storage.path)
+	if err != nil {
+		return fmt.Errorf("can't read replica: %w", err)
+	}
+
+	backupDirectory := filepath.Join(filepath.Dir(storage.path), "backups")
+	err = os.MkdirAll(backupDirectory, 0700)
+	if err != nil {
+		return fmt.Errorf("can't create backup directory: %w", err)
+	}
+	nowTimeStamp := time.Now()
+	backupName := fmt.Sprintf("%s-%s", nowTimeStamp.Format("2006-01-02T15-04-05"), filepath.Base(storage.path))
+	err = os.WriteFile(filepath.Join(backupDirectory, backupName), data, 0600)
+	if err != nil {
+		return fmt.Errorf("can't create backup: %w", err)
+	}
+
+	return nil
+}
+
+func NewFileStorage(path string) *FileStorage {
+	return &FileStorage{path: path}
+}
@@ -0,0 +1,171 @@
+package storage_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"kdbxsync/keepass"
+	"kdbxsync/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestReplica(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "testfile.kdbx")
+	require.NoError(t, os.WriteFile(path, []byte(data), 0600))
+	return path
+}
+
+func readTestReplica(t *testing.T, fileStorage *storage.FileStorage) string {
+	fileObj, err := fileStorage.DownloadRemoteKeepassDB()
+	require.NoError(t, err)
+	defer fileObj.Close()
+	data, err := io.ReadAll(fileObj)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestFileStorageDownload(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		fileStorage := storage.NewFileStorage(writeTestReplica(t, "replica"))
+
+		assert.Equal(t, "replica", readTestReplica(t, fileStorage))
+	})
+
+	t.Run("error: replica is not mounted", func(t *testing.T) {
+		fileStorage := storage.NewFileStorage(filepath.Join(t.TempDir(), "missing", "testfile.kdbx"))
+
+		fileObj, err := fileStorage.DownloadRemoteKeepassDB()
+
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		assert.Nil(t, fileObj)
+	})
+}
+
+func TestFileStorageBackup(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		path := writeTestReplica(t, "replica")
+		fileStorage := storage.NewFileStorage(path)
+
+		require.NoError(t, fileStorage.BackupDBFile())
+
+		backups, err := os.ReadDir(filepath.Join(filepath.Dir(path), "backups"))
+		require.NoError(t, err)
+		require.Len(t, backups, 1)
+		assert.Regexp(t, regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}-testfile\.kdbx$`), backups[0].Name())
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(path), "backups", backups[0].Name()))
+		require.NoError(t, err)
+		assert.Equal(t, "replica", string(data))
+	})
+
+	t.Run("error: replica is not mounted", func(t *testing.T) {
+		fileStorage := storage.NewFileStorage(filepath.Join(t.TempDir(), "testfile.kdbx"))
+
+		err := fileStorage.BackupDBFile()
+
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestFileStorageUpdate(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		path := writeTestReplica(t, "replica")
+		fileStorage := storage.NewFileStorage(path)
+		readTestReplica(t, fileStorage)
+
+		require.NoError(t, fileStorage.UpdateDBFile([]byte("merged")))
+		// the version of its own write is kept, so the next update goes through
+		require.NoError(t, fileStorage.UpdateDBFile([]byte("merged again")))
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "merged again", string(data))
+		// no tmp files are left next to the replica
+		files, err := os.ReadDir(filepath.Dir(path))
+		require.NoError(t, err)
+		assert.Len(t, files, 1)
+	})
+
+	t.Run("success: replica keeps its mode", func(t *testing.T) {
+		path := writeTestReplica(t, "replica")
+		require.NoError(t, os.Chmod(path, 0644))
+		fileStorage := storage.NewFileStorage(path)
+		readTestReplica(t, fileStorage)
+
+		require.NoError(t, fileStorage.UpdateDBFile([]byte("merged")))
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+	})
+
+	t.Run("success: stale leftovers of interrupted writes are removed", func(t *testing.T) {
+		path := writeTestReplica(t, "replica")
+		stale := filepath.Join(filepath.Dir(path), ".testfile.kdbx.kdbxsync-1")
+		require.NoError(t, os.WriteFile(stale, []byte("mer"), 0600))
+		earlier := time.Now().Add(-2 * time.Hour)
+		require.NoError(t, os.Chtimes(stale, earlier, earlier))
+		// a fresh one can be written by another device right now
+		fresh := filepath.Join(filepath.Dir(path), ".testfile.kdbx.kdbxsync-2")
+		require.NoError(t, os.WriteFile(fresh, []byte("oth"), 0600))
+		fileStorage := storage.NewFileStorage(path)
+		readTestReplica(t, fileStorage)
+
+		require.NoError(t, fileStorage.UpdateDBFile([]byte("merged")))
+
+		_, err := os.Stat(stale)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		_, err = os.Stat(fresh)
+		assert.NoError(t, err)
+	})
+
+	t.Run("success: replica which wasn't read", func(t *testing.T) {
+		path := writeTestReplica(t, "replica")
+		fileStorage := storage.NewFileStorage(path)
+
+		require.NoError(t, fileStorage.UpdateDBFile([]byte("merged")))
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "merged", string(data))
+	})
+}
+
+func TestFileStorageUpdateRemoteChanged(t *testing.T) {
+	t.Run("error: replica was rewritten by another device", func(t *testing.T) {
+		path := writeTestReplica(t, "replica")
+		fileStorage := storage.NewFileStorage(path)
+		readTestReplica(t, fileStorage)
+		require.NoError(t, os.WriteFile(path, []byte("changed"), 0600))
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(path, later, later))
+
+		err := fileStorage.UpdateDBFile([]byte("merged"))
+
+		assert.ErrorIs(t, err, keepass.ErrRemoteChanged)
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "changed", string(data))
+	})
+
+	t.Run("error: replica of the same size was touched", func(t *testing.T) {
+		path := writeTestReplica(t, "replica")
+		fileStorage := storage.NewFileStorage(path)
+		readTestReplica(t, fileStorage)
+		require.NoError(t, os.WriteFile(path, []byte("REPLICA"), 0600))
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(path, later, later))
+
+		err := fileStorage.UpdateDBFile([]byte("merged"))
+
+		assert.ErrorIs(t, err, keepass.ErrRemoteChanged)
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "REPLICA", string(data))
+	})
+}
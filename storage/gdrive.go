@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -17,12 +18,37 @@ import (
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
 
+	"kdbxsync/keepass"
 	"kdbxsync/settings"
 )
 
+// fields of the db file which tell its version
+const driveFileFields = "id, name, mimeType, headRevisionId, md5Checksum, modifiedTime"
+
 type googleDriveController struct {
 	service    *drive.Service
 	dbSettings *settings.DataBaseSettings
+	// version of the db file downloaded by the sync, nil until it's downloaded
+	version *driveVersion
+}
+
+type driveVersion struct {
+	revision string
+	checksum string
+	modified string
+}
+
+func versionOfDriveFile(file *drive.File) *driveVersion {
+	return &driveVersion{revision: file.HeadRevisionId, checksum: file.Md5Checksum, modified: file.ModifiedTime}
+}
+
+// dbFile finds the db file along with its version
+func (controller *googleDriveController) dbFile() (*drive.File, error) {
+	file, err := controller.Find(controller.dbSettings.FileName)
+	if err != nil {
+		return nil, err
+	}
+	return controller.service.Files.Get(file.Id).Fields(driveFileFields).Do()
 }
 
 func (controller *googleDriveController) ListFiles(limit int64) (*drive.FileList, error) {
@@ -74,60 +100,52 @@ func (controller *googleDriveController) BackupDBFile() error {
 	return nil
 }
 
-func (controller *googleDriveController) UpdateDBFile() error {
-	filePath := controller.dbSettings.FullFilePath()
-
-	fileObj, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("can't open db file: %w", err)
-	}
-	defer fileObj.Close()
-
-	googleDriveDBFile, err := controller.Find(controller.dbSettings.FileName)
+// UpdateDBFile uploads the merged DB unless another device uploaded a new revision since the download,
+// Drive has no conditional updates so the revision is checked right before the upload
+func (controller *googleDriveController) UpdateDBFile(data []byte) error {
+	googleDriveDBFile, err := controller.dbFile()
 	if err != nil {
 		return fmt.Errorf("can't find db file on google drive: %w", err)
 	}
+	if controller.version != nil && *versionOfDriveFile(googleDriveDBFile) != *controller.version {
+		return fmt.Errorf(
+			"%w: google drive has revision %s modified at %s",
+			keepass.ErrRemoteChanged,
+			googleDriveDBFile.HeadRevisionId,
+			googleDriveDBFile.ModifiedTime,
+		)
+	}
 
 	fileMetaData := &drive.File{
 		Name:     googleDriveDBFile.Name,
 		MimeType: googleDriveDBFile.MimeType,
 	}
-	_, err = controller.service.Files.Update(googleDriveDBFile.Id, fileMetaData).Media(fileObj).Do()
+	updatedFile, err := controller.service.Files.Update(googleDriveDBFile.Id, fileMetaData).
+		Media(bytes.NewReader(data)).Fields(driveFileFields).Do()
 
 	if err != nil {
 		return fmt.Errorf("can't upload file on gogle drive: %w", err)
 	}
+	controller.version = versionOfDriveFile(updatedFile)
 
 	return nil
 }
 
-func (controller *googleDriveController) DownloadRemoteKeepassDB() error {
-	remoteKeepassDB, err := controller.Find(controller.dbSettings.FileName)
+// DownloadRemoteKeepassDB streams the remote base, nothing is stored on disk
+func (controller *googleDriveController) DownloadRemoteKeepassDB() (io.ReadCloser, error) {
+	remoteKeepassDB, err := controller.dbFile()
 	if err != nil {
-		return fmt.Errorf("google drive error: %w", err)
+		return nil, fmt.Errorf("google drive error: %w", err)
 	}
+	// a revision uploaded right after the version is read is downloaded too, its update is refused
+	// as the version doesn't match and the bases are merged again, so nothing is lost
 	googleDriveFileObj, err := controller.service.Files.Get(remoteKeepassDB.Id).Download()
 	if err != nil {
-		return fmt.Errorf("download error: %w", err)
+		return nil, fmt.Errorf("download error: %w", err)
 	}
+	controller.version = versionOfDriveFile(remoteKeepassDB)
 
-	localCopy, err := os.Create(controller.dbSettings.FullRemoteCopyFilePath())
-	if err != nil {
-		return fmt.Errorf("can't create local copy: %w", err)
-	}
-	defer localCopy.Close()
-
-	_, err = io.Copy(localCopy, googleDriveFileObj.Body)
-	if err != nil {
-		return fmt.Errorf("can't copy remote db locally: %w", err)
-	}
-
-	err = googleDriveFileObj.Body.Close()
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return googleDriveFileObj.Body, nil
 }
 
 // Retrieve a token, saves the token, then returns the generated client.
@@ -0,0 +1,154 @@
+package storage_test
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"kdbxsync/keepass"
+	"kdbxsync/settings"
+	"kdbxsync/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+const fakeDriveFileID = "db-file-id"
+
+// google drive fake keeping a single db file
+type fakeDrive struct {
+	name     string
+	data     []byte
+	revision int
+	modified time.Time
+	uploads  int
+}
+
+// upload stores a new revision of the db file, e.g. one uploaded by another device
+func (fake *fakeDrive) upload(data []byte) {
+	fake.data = data
+	fake.revision++
+	fake.modified = fake.modified.Add(time.Second)
+}
+
+func (fake *fakeDrive) file() *drive.File {
+	checksum := md5.Sum(fake.data)
+	return &drive.File{
+		Id:             fakeDriveFileID,
+		Name:           fake.name,
+		MimeType:       "application/octet-stream",
+		HeadRevisionId: strconv.Itoa(fake.revision),
+		Md5Checksum:    hex.EncodeToString(checksum[:]),
+		ModifiedTime:   fake.modified.Format(time.RFC3339),
+	}
+}
+
+func (fake *fakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/drive/v3/files":
+		writeJSON(w, &drive.FileList{Files: []*drive.File{{Id: fakeDriveFileID, Name: fake.name}}})
+	case r.Method == http.MethodGet && r.URL.Path == "/drive/v3/files/"+fakeDriveFileID:
+		if r.URL.Query().Get("alt") == "media" {
+			_, _ = w.Write(fake.data)
+			return
+		}
+		writeJSON(w, fake.file())
+	case r.Method == http.MethodPatch && r.URL.Path == "/upload/drive/v3/files/"+fakeDriveFileID:
+		data, err := readMedia(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fake.upload(data)
+		fake.uploads++
+		writeJSON(w, fake.file())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+// readMedia reads the content of a multipart upload, the first part is the metadata
+func readMedia(r *http.Request) ([]byte, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	_, err = reader.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	media, err := reader.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(media)
+}
+
+func newTestDriveStorage(t *testing.T, fake *fakeDrive) *storage.Storage {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	service, err := drive.NewService(
+		context.Background(),
+		option.WithEndpoint(server.URL+"/drive/v3/"),
+		option.WithHTTPClient(server.Client()),
+	)
+	require.NoError(t, err)
+	appSettings := &settings.AppSettings{
+		DatabaseSettings: &settings.DataBaseSettings{FileName: fake.name},
+	}
+	return storage.NewGoogleDriveStorage(service, appSettings)
+}
+
+func downloadTestDriveFile(t *testing.T, driveStorage *storage.Storage) string {
+	fileObj, err := driveStorage.DownloadRemoteKeepassDB()
+	require.NoError(t, err)
+	defer fileObj.Close()
+	data, err := io.ReadAll(fileObj)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestGoogleDriveUpdateRemoteChanged(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		fake := &fakeDrive{name: "testfile.kdbx", data: []byte("remote"), modified: time.Now()}
+		driveStorage := newTestDriveStorage(t, fake)
+		assert.Equal(t, "remote", downloadTestDriveFile(t, driveStorage))
+
+		require.NoError(t, driveStorage.UpdateDBFile([]byte("merged")))
+		// the revision of its own upload is kept, so the next update goes through
+		require.NoError(t, driveStorage.UpdateDBFile([]byte("merged again")))
+
+		assert.Equal(t, "merged again", string(fake.data))
+		assert.Equal(t, 2, fake.uploads)
+	})
+
+	t.Run("error: another device uploaded a new revision", func(t *testing.T) {
+		fake := &fakeDrive{name: "testfile.kdbx", data: []byte("remote"), modified: time.Now()}
+		driveStorage := newTestDriveStorage(t, fake)
+		downloadTestDriveFile(t, driveStorage)
+		fake.upload([]byte("changed"))
+
+		err := driveStorage.UpdateDBFile([]byte("merged"))
+
+		assert.ErrorIs(t, err, keepass.ErrRemoteChanged)
+		assert.Equal(t, "changed", string(fake.data))
+		assert.Equal(t, 0, fake.uploads)
+	})
+}
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"io"
+
 	"kdbxsync/settings"
 )
 
@@ -9,20 +11,20 @@ type Storage struct {
 	Service  *googleDriveController
 }
 
-func (storage *Storage) UpdateDBFile() error {
-	err := storage.Service.UpdateDBFile()
+func (storage *Storage) UpdateDBFile(data []byte) error {
+	err := storage.Service.UpdateDBFile(data)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (storage *Storage) DownloadRemoteKeepassDB() error {
-	err := storage.Service.DownloadRemoteKeepassDB()
+func (storage *Storage) DownloadRemoteKeepassDB() (io.ReadCloser, error) {
+	remoteDBObj, err := storage.Service.DownloadRemoteKeepassDB()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return remoteDBObj, nil
 }
 
 func (storage *Storage) BackupDBFile() error {